@@ -0,0 +1,154 @@
+package wikie
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"github.com/go-errors/errors"
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxAttachmentText is the most text extracted from a single attachment.
+const maxAttachmentText = 1 << 20
+
+// ErrUnsupportedAttachment is returned when text cannot be extracted from a file type.
+var ErrUnsupportedAttachment = errors.New("unsupported attachment type")
+
+// Attachment is a file uploaded to storage, indexed so that it can be searched.
+type Attachment struct {
+	// Path is the location of the file in storage, e.g. /ops/runbook.pdf.
+	Path string `json:"path"`
+	// Page is the namespace the file was uploaded to, e.g. /ops.
+	Page        string    `json:"page"`
+	Name        string    `json:"name"`
+	Body        string    `json:"body"`
+	LastUpdated time.Time `json:"updated"`
+	EditedBy    string    `json:"edited"`
+}
+
+// ExtractText returns the plain text of a file, choosing the format from the
+// extension of name.
+func ExtractText(name string, r io.Reader) (string, error) {
+	var text string
+	var err error
+	switch strings.ToLower(path.Ext(name)) {
+	case ".txt", ".text", ".md", ".markdown", ".csv", ".log":
+		var b []byte
+		b, err = ioutil.ReadAll(io.LimitReader(r, maxAttachmentText))
+		text = string(b)
+	case ".html", ".htm":
+		text, err = htmlText(r)
+	case ".pdf":
+		text, err = pdfText(r)
+	case ".docx":
+		text, err = zipXMLText(r, "word/document.xml", "p")
+	case ".odt":
+		text, err = zipXMLText(r, "content.xml", "p", "h")
+	default:
+		return "", ErrUnsupportedAttachment
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(text) > maxAttachmentText {
+		text = text[:maxAttachmentText]
+	}
+	return text, nil
+}
+
+func htmlText(r io.Reader) (string, error) {
+	var text strings.Builder
+	skip := false
+	z := html.NewTokenizer(io.LimitReader(r, 4*maxAttachmentText))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return text.String(), nil
+			}
+			return "", z.Err()
+		case html.StartTagToken, html.EndTagToken:
+			token := z.Token()
+			switch token.Data {
+			case "script", "style":
+				// A stray end tag must not start skipping the rest.
+				skip = token.Type == html.StartTagToken
+			case "p", "div", "br", "li", "tr", "h1", "h2", "h3", "h4", "h5", "h6":
+				text.WriteString("\n")
+			}
+		case html.TextToken:
+			if !skip {
+				text.Write(z.Text())
+			}
+		}
+	}
+}
+
+func pdfText(r io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	doc, err := pdf.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return "", err
+	}
+	plain, err := doc.GetPlainText()
+	if err != nil {
+		return "", err
+	}
+	text, err := ioutil.ReadAll(io.LimitReader(plain, maxAttachmentText))
+	return string(text), err
+}
+
+// zipXMLText extracts the character data of the named XML document inside a
+// zip archive (as used by DOCX and ODT), starting a new line at each of the
+// paragraph elements.
+func zipXMLText(r io.Reader, document string, paragraphs ...string) (string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	archive, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return "", err
+	}
+	for _, f := range archive.File {
+		if f.Name != document {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+
+		var text strings.Builder
+		d := xml.NewDecoder(io.LimitReader(rc, 8*maxAttachmentText))
+		for {
+			tok, err := d.Token()
+			if err == io.EOF {
+				return text.String(), nil
+			} else if err != nil {
+				return "", err
+			}
+			switch t := tok.(type) {
+			case xml.EndElement:
+				for _, p := range paragraphs {
+					if t.Name.Local == p {
+						text.WriteString("\n")
+					}
+				}
+			case xml.CharData:
+				text.Write(t)
+			}
+		}
+	}
+	return "", errors.New("document not found in archive")
+}
@@ -0,0 +1,26 @@
+package wikie
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHTMLText(t *testing.T) {
+	for _, test := range []struct {
+		doc, want string
+	}{
+		{`<p>a</p><p>b</p>`, "\na\n\nb\n"},
+		{`<style>p { color: red }</style>a<script>var b;</script>c`, "ac"},
+		// A stray end tag does not hide what follows it.
+		{`a</style>b</script>c`, "abc"},
+		{`<script>x</script></script>a`, "a"},
+	} {
+		got, err := htmlText(strings.NewReader(test.doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("htmlText(%q) = %q, want %q", test.doc, got, test.want)
+		}
+	}
+}
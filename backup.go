@@ -0,0 +1,707 @@
+package wikie
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/olivere/elastic/v7"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	backupFormat = "wikie-backup"
+	// BackupVersion is the version of the archives written by Backup. Restore
+	// reads archives of this version or older.
+	BackupVersion = 1
+)
+
+// backupBuckets are the parts of the bolt database which are backed up.
+// Logins, in the sessions bucket, are left out so that restoring a backup
+// cannot log anyone back in.
+var backupBuckets = []string{"perms", "profiles", "files", "shares", "revisions"}
+
+// backupTokenLifetime is how long a token made by BackupToken is accepted.
+const backupTokenLifetime = time.Minute
+
+// BackupToken authorises a download of a backup from the running wiki, for
+// the backup command, which reads the same configuration as the server.
+func BackupToken(secret string, now time.Time) string {
+	t := strconv.FormatInt(now.Unix(), 10)
+	return t + "." + base64.RawURLEncoding.EncodeToString(backupSignature(secret, t))
+}
+
+// CheckBackupToken reports whether token was made by BackupToken with secret
+// within the last minute.
+func CheckBackupToken(secret, token string, now time.Time) bool {
+	if len(secret) == 0 {
+		return false
+	}
+	i := strings.Index(token, ".")
+	if i < 0 {
+		return false
+	}
+	unix, err := strconv.ParseInt(token[:i], 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > backupTokenLifetime || age < -backupTokenLifetime {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(signature, backupSignature(secret, token[:i]))
+}
+
+func backupSignature(secret, t string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "backup\n%s", t)
+	return mac.Sum(nil)
+}
+
+type backupManifest struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+type backupDocument struct {
+	ID     string          `json:"id"`
+	Source json.RawMessage `json:"source"`
+}
+
+type backupRecord struct {
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value"`
+}
+
+// Backup writes every page, attachment, permission, profile, share link and
+// stored file to w as a gzipped tar archive. It can run while the wiki is in
+// use: the database is read in a single transaction, and each file is copied
+// from the version its history records, so the archive is consistent with
+// the metadata in it. Progress is written to log.
+func Backup(ctx context.Context, client *elastic.Client, db *bolt.DB, blobs BlobStore, w io.Writer, log io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest, err := json.Marshal(backupManifest{Format: backupFormat, Version: BackupVersion, Created: time.Now()})
+	if err != nil {
+		return err
+	}
+	err = writeTarFile(tw, "manifest.json", manifest)
+	if err != nil {
+		return err
+	}
+
+	// The database and indices are spooled to temporary files, as the size
+	// of each entry must be known before it is written to the archive.
+	var histories []FileHistory
+	err = spoolTarFile(tw, "database.jsonl", time.Now(), func(w io.Writer) error {
+		return db.View(func(tx *bolt.Tx) error {
+			enc := json.NewEncoder(w)
+			for _, name := range backupBuckets {
+				bucket := tx.Bucket([]byte(name))
+				if bucket == nil {
+					continue
+				}
+				err := bucket.ForEach(func(k, v []byte) error {
+					if name == "revisions" {
+						// Each page's revisions are a bucket of their own, and
+						// are archived as one history.
+						revisions, err := pageRevisions(bucket, string(k))
+						if err != nil {
+							return err
+						}
+						v, err = json.Marshal(PageHistory{Path: string(k), Revisions: revisions})
+						if err != nil {
+							return err
+						}
+					}
+					if name == "files" {
+						var history FileHistory
+						err := json.Unmarshal(v, &history)
+						if err != nil {
+							return err
+						}
+						histories = append(histories, history)
+					}
+					return enc.Encode(backupRecord{Bucket: name, Key: string(k), Value: v})
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(log, "backed up the database\n")
+
+	for _, index := range []struct{ alias, name string }{{PageIndex, "pages.jsonl"}, {AttachmentIndex, "attachments.jsonl"}} {
+		var n int
+		err := spoolTarFile(tw, index.name, time.Now(), func(w io.Writer) error {
+			var err error
+			n, err = backupIndex(ctx, client, index.alias, w)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(log, "backed up %d documents from %s\n", n, index.alias)
+	}
+
+	// Every version is kept under its hash, and the current file is restored
+	// from its version. Files from before histories were kept are copied as
+	// they are.
+	written := make(map[string]bool)
+	withHistory := make(map[string]bool)
+	for _, history := range histories {
+		withHistory[StorageKey(history.Path)] = true
+		for _, version := range history.Versions {
+			key := versionsPrefix + version.Hash
+			if written[key] || len(version.Hash) == 0 {
+				continue
+			}
+			err := backupBlob(ctx, tw, blobs, key)
+			if err == ErrBlobNotFound {
+				fmt.Fprintf(log, "skipped missing version %d of %s\n", version.Version, history.Path)
+				continue
+			} else if err != nil {
+				return err
+			}
+			written[key] = true
+		}
+	}
+	current, err := blobs.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, blob := range current {
+		if withHistory[blob.Key] {
+			continue
+		}
+		err := backupCurrentBlob(ctx, tw, blobs, blob.Key)
+		if err == ErrBlobNotFound {
+			// Deleted since it was listed.
+			continue
+		} else if err != nil {
+			return err
+		}
+		written[blob.Key] = true
+	}
+	fmt.Fprintf(log, "backed up %d files\n", len(written))
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, b []byte) error {
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), ModTime: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(b)
+	return err
+}
+
+// spoolTarFile adds what write writes to the archive as name, by way of a
+// temporary file, so that it need not fit in memory.
+func spoolTarFile(tw *tar.Writer, name string, modTime time.Time, write func(w io.Writer) error) error {
+	f, err := ioutil.TempFile("", "wikie-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	err = write(bw)
+	if err != nil {
+		return err
+	}
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, size)
+	return err
+}
+
+// backupBlob streams a version into the archive. Versions are named by their
+// hash and never change, so the size they are opened with is the size read.
+func backupBlob(ctx context.Context, tw *tar.Writer, blobs BlobStore, key string) error {
+	r, info, err := blobs.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	err = tw.WriteHeader(&tar.Header{Name: "files/" + key, Mode: 0644, Size: info.Size, ModTime: info.ModTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, r, info.Size)
+	return err
+}
+
+// backupCurrentBlob adds a file from before histories were kept to the
+// archive. It can be replaced while it is read, so it is spooled to find out
+// how large what was read is.
+func backupCurrentBlob(ctx context.Context, tw *tar.Writer, blobs BlobStore, key string) error {
+	r, info, err := blobs.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return spoolTarFile(tw, "files/"+key, info.ModTime, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// backupIndex writes every document of the index behind alias to w, returning
+// how many were written.
+func backupIndex(ctx context.Context, client *elastic.Client, alias string, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	n := 0
+	scroll := client.Scroll(alias).Size(reindexBatchSize)
+	defer scroll.Clear(ctx)
+	for {
+		result, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		for _, hit := range result.Hits.Hits {
+			if hit.Source == nil {
+				continue
+			}
+			err := enc.Encode(backupDocument{ID: hit.Id, Source: hit.Source})
+			if err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+}
+
+// Restore reads an archive written by Backup, adding what is in it to the
+// wiki and replacing anything with the same path, except pages and files
+// which have changed since the backup was made. With dryRun, the archive is
+// checked and what would be restored is written to log, but nothing is changed.
+func Restore(ctx context.Context, client *elastic.Client, db *bolt.DB, blobs BlobStore, r io.Reader, dryRun bool, log io.Writer) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	header, err := tr.Next()
+	if err != nil {
+		return err
+	}
+	if header.Name != "manifest.json" {
+		return fmt.Errorf("not a wikie backup: %s is not the manifest", header.Name)
+	}
+	var manifest backupManifest
+	err = json.NewDecoder(tr).Decode(&manifest)
+	if err != nil {
+		return err
+	}
+	if manifest.Format != backupFormat {
+		return fmt.Errorf("not a wikie backup: format is %q", manifest.Format)
+	}
+	if manifest.Version > BackupVersion {
+		return fmt.Errorf("backup version %d is newer than this wikie can restore (%d)", manifest.Version, BackupVersion)
+	}
+	fmt.Fprintf(log, "restoring backup version %d made %s\n", manifest.Version, manifest.Created.Format(time.RFC3339))
+
+	var histories []FileHistory
+	files := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch {
+		case header.Name == "database.jsonl":
+			histories, err = restoreDatabase(db, tr, dryRun, log)
+		case header.Name == "pages.jsonl":
+			err = restoreIndex(ctx, client, PageIndex, tr, dryRun, log)
+		case header.Name == "attachments.jsonl":
+			err = restoreIndex(ctx, client, AttachmentIndex, tr, dryRun, log)
+		case strings.HasPrefix(header.Name, "files/"):
+			key := strings.TrimPrefix(header.Name, "files/")
+			if !strings.HasPrefix(key, versionsPrefix) {
+				// A file from before histories were kept has been
+				// uploaded again since the backup if it has one now.
+				var history FileHistory
+				history, err = GetFileHistory(db, "/"+key)
+				if err != nil {
+					return err
+				}
+				if len(history.Versions) > 0 {
+					fmt.Fprintf(log, "kept %s, which changed since the backup\n", "/"+key)
+					continue
+				}
+			}
+			if !dryRun {
+				err = blobs.Put(ctx, key, tr, header.Size, "")
+			}
+			files++
+		default:
+			fmt.Fprintf(log, "skipped unknown entry %s\n", header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(log, "restored %d files\n", files)
+
+	// Put each file back as its current version.
+	for _, history := range histories {
+		current := history.Current()
+		if len(current.Hash) == 0 {
+			continue
+		}
+		if dryRun {
+			fmt.Fprintf(log, "would restore %s as version %d\n", history.Path, current.Version)
+			continue
+		}
+		f, info, err := blobs.Open(ctx, versionsPrefix+current.Hash)
+		if err == ErrBlobNotFound {
+			fmt.Fprintf(log, "skipped %s: version %d is not in the backup\n", history.Path, current.Version)
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = blobs.Put(ctx, StorageKey(history.Path), f, info.Size, "")
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreDatabase adds the records in r to the database, except those which
+// have changed since they were backed up, returning the histories of the
+// files restored.
+func restoreDatabase(db *bolt.DB, r io.Reader, dryRun bool, log io.Writer) ([]FileHistory, error) {
+	var records []backupRecord
+	counts := make(map[string]int)
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for dec.More() {
+		var record backupRecord
+		err := dec.Decode(&record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+		counts[record.Bucket]++
+	}
+
+	var histories []FileHistory
+	kept := make(map[string]int)
+	restore := func(tx *bolt.Tx) error {
+		for _, record := range records {
+			bucket := tx.Bucket([]byte(record.Bucket))
+			if bucket == nil && !dryRun {
+				var err error
+				bucket, err = tx.CreateBucketIfNotExists([]byte(record.Bucket))
+				if err != nil {
+					return err
+				}
+			}
+			value, err := restoredValue(bucket, record)
+			if err != nil {
+				return err
+			}
+			if value == nil {
+				kept[record.Bucket]++
+				continue
+			}
+			if record.Bucket == "files" {
+				var history FileHistory
+				err := json.Unmarshal(value, &history)
+				if err != nil {
+					return err
+				}
+				histories = append(histories, history)
+			}
+			if dryRun {
+				continue
+			}
+			if record.Bucket == "revisions" {
+				var history PageHistory
+				err := json.Unmarshal(value, &history)
+				if err != nil {
+					return err
+				}
+				err = replacePageRevisions(bucket, record.Key, history.Revisions)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			err = bucket.Put([]byte(record.Key), value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var err error
+	if dryRun {
+		err = db.View(restore)
+	} else {
+		err = db.Update(func(tx *bolt.Tx) error {
+			// The storage totals are built again from what is restored.
+			err := tx.DeleteBucket([]byte("usage"))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			return restore(tx)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range backupBuckets {
+		fmt.Fprintf(log, "restored %d %s, kept %d which changed since the backup\n", counts[name]-kept[name], name, kept[name])
+	}
+	return histories, nil
+}
+
+// restoredValue is what a record from an archive is restored as, or nil when
+// what the database has instead is newer and is kept. Pages and files are
+// compared by when they were last saved, and the permissions of a user are
+// merged. Profiles and share links are only added when they are missing, as
+// they carry no time to compare.
+func restoredValue(bucket *bolt.Bucket, record backupRecord) ([]byte, error) {
+	if bucket == nil {
+		return record.Value, nil
+	}
+	key := []byte(record.Key)
+	switch record.Bucket {
+	case "revisions":
+		existing, err := pageRevisions(bucket, record.Key)
+		if err != nil || len(existing) == 0 {
+			return record.Value, err
+		}
+		var history PageHistory
+		err = json.Unmarshal(record.Value, &history)
+		if err != nil {
+			return nil, err
+		}
+		if len(history.Revisions) == 0 || existing[len(existing)-1].Updated.After(history.Revisions[len(history.Revisions)-1].Updated) {
+			return nil, nil
+		}
+	case "files":
+		v := bucket.Get(key)
+		if v == nil {
+			return record.Value, nil
+		}
+		var existing, history FileHistory
+		err := json.Unmarshal(v, &existing)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(record.Value, &history)
+		if err != nil {
+			return nil, err
+		}
+		if existing.Current().Uploaded.After(history.Current().Uploaded) {
+			return nil, nil
+		}
+	case "perms":
+		v := bucket.Get(key)
+		if v == nil {
+			return record.Value, nil
+		}
+		var existing, perms []Permission
+		err := json.Unmarshal(v, &existing)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(record.Value, &perms)
+		if err != nil {
+			return nil, err
+		}
+		granted := make(map[string]bool)
+		for _, perm := range existing {
+			granted[perm.Path] = true
+		}
+		for _, perm := range perms {
+			if !granted[perm.Path] {
+				existing = append(existing, perm)
+			}
+		}
+		return json.Marshal(existing)
+	default:
+		if bucket.Get(key) != nil {
+			return nil, nil
+		}
+	}
+	return record.Value, nil
+}
+
+// restoredDocument is a document from an archive waiting to be restored.
+type restoredDocument struct {
+	id     string
+	source map[string]interface{}
+}
+
+// restoreIndex adds the documents in r to the index behind alias, except
+// those which have been updated since they were backed up. Each document is
+// only written if it has not changed since it was compared, so edits made
+// while restoring are kept too.
+func restoreIndex(ctx context.Context, client *elastic.Client, alias string, r io.Reader, dryRun bool, log io.Writer) error {
+	n := 0
+	var batch []restoredDocument
+	flush := func() error {
+		if dryRun || len(batch) == 0 {
+			batch = nil
+			return nil
+		}
+		mget := client.Mget()
+		for _, doc := range batch {
+			mget.Add(elastic.NewMultiGetItem().Index(alias).Id(doc.id).FetchSource(elastic.NewFetchSourceContext(true).Include("updated")))
+		}
+		current, err := mget.Do(ctx)
+		if err != nil {
+			return err
+		}
+		if len(current.Docs) != len(batch) {
+			return fmt.Errorf("could not read %d documents from %s", len(batch), alias)
+		}
+
+		bulk := client.Bulk()
+		for i, doc := range batch {
+			req := elastic.NewBulkIndexRequest().Index(alias).Id(doc.id).Doc(doc.source)
+			if existing := current.Docs[i]; existing.Found {
+				if newerDocument(existing.Source, doc.source) {
+					fmt.Fprintf(log, "kept %s, which is newer than the backup\n", doc.id)
+					continue
+				}
+				if existing.SeqNo != nil && existing.PrimaryTerm != nil {
+					req = req.IfSeqNo(*existing.SeqNo).IfPrimaryTerm(*existing.PrimaryTerm)
+				}
+			} else {
+				req = req.OpType("create")
+			}
+			bulk.Add(req)
+		}
+		batch = nil
+		if bulk.NumberOfActions() == 0 {
+			return nil
+		}
+		resp, err := bulk.Do(ctx)
+		if err != nil {
+			return err
+		}
+		if resp.Errors {
+			for _, failed := range resp.Failed() {
+				if failed.Status == http.StatusConflict {
+					fmt.Fprintf(log, "kept %s, which changed while restoring\n", failed.Id)
+					continue
+				}
+				if failed.Error != nil {
+					return fmt.Errorf("could not restore %s: %s", failed.Id, failed.Error.Reason)
+				}
+			}
+		}
+		return nil
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for dec.More() {
+		var doc backupDocument
+		err := dec.Decode(&doc)
+		if err != nil {
+			return err
+		}
+		// Older archives are brought up to the current mappings.
+		source, err := migrateDocument(alias, doc.ID, doc.Source)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, restoredDocument{id: doc.ID, source: source})
+		n++
+		if len(batch) >= reindexBatchSize {
+			err := flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := flush()
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		_, err = client.Refresh(alias).Do(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(log, "restoring %d documents to %s\n", n, alias)
+	return nil
+}
+
+// newerDocument reports whether the document in the index, whose source is
+// existing, was updated after the one from the backup. Documents without a
+// time they were updated are replaced.
+func newerDocument(existing json.RawMessage, backup map[string]interface{}) bool {
+	var doc struct {
+		Updated string `json:"updated"`
+	}
+	if json.Unmarshal(existing, &doc) != nil {
+		return false
+	}
+	updated, err := ParseTimestamp(doc.Updated)
+	if err != nil {
+		return false
+	}
+	v, _ := backup["updated"].(string)
+	backedUp, err := ParseTimestamp(v)
+	if err != nil {
+		return false
+	}
+	return updated.After(backedUp)
+}
@@ -0,0 +1,115 @@
+package wikie
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreDatabase(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "perms.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = Init(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backedUp := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	later := backedUp.Add(time.Hour)
+
+	// The wiki has changed since the backup: /a was edited and f.txt uploaded again.
+	err = AddPageRevisions(db, "/a", PageRevision{Body: "a1", Updated: backedUp}, PageRevision{Body: "a2", Updated: later})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = AddPageRevisions(db, "/b", PageRevision{Body: "b0", Updated: backedUp.Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = AddFileVersion(db, "/a/f.txt", FileVersion{Hash: "1", Uploaded: backedUp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = AddFileVersion(db, "/a/f.txt", FileVersion{Hash: "2", Uploaded: later})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = AddPermission(db, "u", "/a", PermissionRead|PermissionWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	enc := json.NewEncoder(&archive)
+	record := func(bucket, key string, v interface{}) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc.Encode(backupRecord{Bucket: bucket, Key: key, Value: b})
+	}
+	record("revisions", "/a", PageHistory{Path: "/a", Revisions: []PageRevision{{Version: 1, Body: "a1", Updated: backedUp}}})
+	record("revisions", "/b", PageHistory{Path: "/b", Revisions: []PageRevision{{Version: 1, Body: "b0"}, {Version: 2, Body: "b1", Updated: backedUp}}})
+	record("files", "/a/f.txt", FileHistory{Path: "/a/f.txt", Versions: []FileVersion{{Version: 1, Hash: "1", Uploaded: backedUp}}})
+	record("files", "/c/g.txt", FileHistory{Path: "/c/g.txt", Versions: []FileVersion{{Version: 1, Hash: "3", Uploaded: backedUp}}})
+	record("perms", "u", []Permission{{Path: "/a", Access: PermissionRead}, {Path: "/c", Access: PermissionRead}})
+
+	histories, err := restoreDatabase(db, &archive, false, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 1 || histories[0].Path != "/c/g.txt" {
+		t.Errorf("restored file histories = %v, want only /c/g.txt", histories)
+	}
+
+	a, _ := GetPageHistory(db, "/a")
+	if len(a.Revisions) != 2 || a.Revisions[1].Body != "a2" {
+		t.Errorf("/a was rolled back to %v", a.Revisions)
+	}
+	b, _ := GetPageHistory(db, "/b")
+	if len(b.Revisions) != 2 || b.Revisions[1].Body != "b1" {
+		t.Errorf("/b was not restored: %v", b.Revisions)
+	}
+	f, _ := GetFileHistory(db, "/a/f.txt")
+	if f.Current().Hash != "2" {
+		t.Errorf("/a/f.txt was rolled back to %v", f.Current())
+	}
+	perms, _ := GetUserPermissions(db, "u")
+	got := make(map[string]AccessType)
+	for _, perm := range perms["u"] {
+		got[perm.Path] = perm.Access
+	}
+	if got["/a"] != PermissionRead|PermissionWrite || got["/c"] != PermissionRead {
+		t.Errorf("permissions of u = %v", got)
+	}
+}
+
+func TestBackupToken(t *testing.T) {
+	now := time.Now()
+	token := BackupToken("secret", now)
+	for _, test := range []struct {
+		secret, token string
+		at            time.Time
+		want          bool
+	}{
+		{"secret", token, now, true},
+		{"secret", token, now.Add(30 * time.Second), true},
+		{"secret", token, now.Add(2 * time.Minute), false},
+		{"other", token, now, false},
+		{"", BackupToken("", now), now, false},
+		{"secret", "1" + token, now, false},
+		{"secret", token + "x", now, false},
+		{"secret", "", now, false},
+	} {
+		if got := CheckBackupToken(test.secret, test.token, test.at); got != test.want {
+			t.Errorf("CheckBackupToken(%q, %q) = %v, want %v", test.secret, test.token, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package wikie
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-errors/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrBlobNotFound is returned when a key does not exist in a BlobStore.
+var ErrBlobNotFound = errors.New("file not found")
+
+// BlobInfo describes a file held in a BlobStore.
+type BlobInfo struct {
+	// Key is the slash-separated location of the file, e.g. ops/runbook.pdf.
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore holds the files uploaded to storage.
+type BlobStore interface {
+	// Put stores the contents of r under key, replacing any existing file.
+	// The size may be -1 when it is not known in advance.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Open returns the contents of the file under key. The reader supports
+	// seeking so that ranges of the file can be served.
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, BlobInfo, error)
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+	Delete(ctx context.Context, key string) error
+	// List returns every file whose key starts with prefix, sorted by key.
+	// Files under hidden path elements below the folder of the prefix are
+	// not listed, so wikie's own files are only listed when asked for.
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+}
+
+// NewBlobStore creates the BlobStore selected in the configuration.
+func NewBlobStore(config StorageConfig) (BlobStore, error) {
+	switch config.Backend {
+	case "", "local":
+		root := config.Path
+		if len(root) == 0 {
+			root = "storage"
+		}
+		return NewLocalBlobStore(root), nil
+	case "s3":
+		return NewS3BlobStore(config.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %s", config.Backend)
+	}
+}
+
+// LocalBlobStore keeps files in a directory on the local filesystem.
+type LocalBlobStore struct {
+	root string
+}
+
+func NewLocalBlobStore(root string) *LocalBlobStore {
+	return &LocalBlobStore{root: root}
+}
+
+// path returns where the file with key is kept. Keys which are not in their
+// canonical form, or which pass through a symbolic link, are rejected so that
+// nothing outside the root can be reached. Unlike ResolveStoragePath, hidden
+// elements are allowed, as wikie keeps its own files under them.
+func (l *LocalBlobStore) path(key string) (string, error) {
+	if strings.ContainsAny(key, "\\\x00") || strings.HasPrefix(key, "/") {
+		return "", ErrUnsafePath
+	}
+	for i, elem := range strings.Split(key, "/") {
+		if elem == "." || elem == ".." || (len(elem) == 0 && len(key) > 0) || (i == 0 && strings.HasSuffix(elem, ":")) {
+			return "", ErrUnsafePath
+		}
+	}
+
+	p := l.root
+	for _, elem := range strings.Split(key, "/") {
+		if len(elem) == 0 {
+			continue
+		}
+		p = filepath.Join(p, elem)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			// Nothing below here exists yet, so it cannot be a link.
+			return filepath.Join(l.root, filepath.FromSlash(key)), nil
+		} else if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", ErrUnsafePath
+		}
+	}
+	return p, nil
+}
+
+func (l *LocalBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0777)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partial file.
+	f, err := ioutil.TempFile(filepath.Dir(p), ".upload-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (l *LocalBlobStore) Open(ctx context.Context, key string) (io.ReadSeekCloser, BlobInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, BlobInfo{}, ErrBlobNotFound
+	} else if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, BlobInfo{}, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, BlobInfo{}, ErrBlobNotFound
+	}
+	return f, BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *LocalBlobStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return BlobInfo{}, ErrBlobNotFound
+	} else if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (l *LocalBlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	// Only walk the directory the prefix is in.
+	start := l.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		var err error
+		start, err = l.path(prefix[:i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var blobs []BlobInfo
+	err := filepath.Walk(start, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// Hidden files and directories belong to wikie rather than users.
+		if strings.HasPrefix(info.Name(), ".") && p != start {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			blobs = append(blobs, BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Key < blobs[j].Key
+	})
+	return blobs, err
+}
@@ -0,0 +1,113 @@
+package wikie
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testBlobStore checks that store behaves as a BlobStore should. It must be
+// empty to begin with.
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+
+	if _, _, err := store.Open(ctx, "a/missing.txt"); err != ErrBlobNotFound {
+		t.Fatalf("Open of a missing file: got %v, want ErrBlobNotFound", err)
+	}
+	if _, err := store.Stat(ctx, "a/missing.txt"); err != ErrBlobNotFound {
+		t.Fatalf("Stat of a missing file: got %v, want ErrBlobNotFound", err)
+	}
+
+	put := func(key, content string, size int64) {
+		t.Helper()
+		err := store.Put(ctx, key, strings.NewReader(content), size, "text/plain")
+		if err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+	put("a/b.txt", "hello", 5)
+	// The size is not always known in advance.
+	put("a/c/d.txt", "world!", -1)
+	put("ab.txt", "sibling", 7)
+	put("a/.hidden/x.txt", "hidden", 6)
+	put("a/c/.e", "hidden", 6)
+
+	r, info, err := store.Open(ctx, "a/b.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("Open read %q, %v; want hello", b, err)
+	}
+	if info.Key != "a/b.txt" || info.Size != 5 || info.ModTime.IsZero() {
+		t.Fatalf("Open info %+v", info)
+	}
+	_, err = r.Seek(1, io.SeekStart)
+	if err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	b, err = ioutil.ReadAll(r)
+	if err != nil || string(b) != "ello" {
+		t.Fatalf("read after Seek %q, %v; want ello", b, err)
+	}
+	r.Close()
+
+	info, err = store.Stat(ctx, "a/c/d.txt")
+	if err != nil || info.Key != "a/c/d.txt" || info.Size != 6 {
+		t.Fatalf("Stat: %+v, %v", info, err)
+	}
+
+	for prefix, want := range map[string][]string{
+		"a/":  {"a/b.txt", "a/c/d.txt"},
+		"a":   {"a/b.txt", "a/c/d.txt", "ab.txt"},
+		"":    {"a/b.txt", "a/c/d.txt", "ab.txt"},
+		"a/c": {"a/c/d.txt"},
+		"z/":  nil,
+		// Hidden files are listed when the prefix is under them.
+		"a/.hidden/": {"a/.hidden/x.txt"},
+		"a/.h":       nil,
+	} {
+		blobs, err := store.List(ctx, prefix)
+		if err != nil {
+			t.Fatalf("List %q: %v", prefix, err)
+		}
+		var keys []string
+		for _, blob := range blobs {
+			keys = append(keys, blob.Key)
+		}
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("List %q = %v, want %v", prefix, keys, want)
+		}
+	}
+
+	put("a/b.txt", "replaced", 8)
+	r, _, err = store.Open(ctx, "a/b.txt")
+	if err != nil {
+		t.Fatalf("Open after replacing: %v", err)
+	}
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, r)
+	r.Close()
+	if err != nil || buf.String() != "replaced" {
+		t.Fatalf("Open after replacing read %q, %v", buf.String(), err)
+	}
+
+	if err := store.Delete(ctx, "a/b.txt"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Stat(ctx, "a/b.txt"); err != ErrBlobNotFound {
+		t.Fatalf("Stat after Delete: got %v, want ErrBlobNotFound", err)
+	}
+	if err := store.Delete(ctx, "a/b.txt"); err != nil {
+		t.Fatalf("Delete of a missing file: %v", err)
+	}
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	testBlobStore(t, NewLocalBlobStore(t.TempDir()))
+}
@@ -0,0 +1,533 @@
+package wikie
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/go-errors/errors"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	htmltemplate "html/template"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// The formats a bundle of pages can be exported in.
+const (
+	BundleMarkdown = "zip"
+	BundleHTML     = "html"
+	BundleEPUB     = "epub"
+)
+
+const (
+	// maxInlineFile is the largest file put into a single html file, or into
+	// an EPUB.
+	maxInlineFile = 10 << 20
+	// maxBundlePages and maxBundleSize limit how much is exported at once, in
+	// pages and in bytes of pages and files.
+	maxBundlePages = 1000
+	maxBundleSize  = 1 << 30
+)
+
+var (
+	// ErrUnknownBundle is returned when pages are exported in a format that does not exist.
+	ErrUnknownBundle = errors.New("unknown export format")
+	// ErrBundleTooLarge is returned when there is too much to export at once.
+	ErrBundleTooLarge = errors.New("too much to export at once")
+)
+
+// epubTypes are the types of file which every EPUB reader can show.
+var epubTypes = map[string]bool{
+	"image/gif":     true,
+	"image/jpeg":    true,
+	"image/png":     true,
+	"image/svg+xml": true,
+	"image/webp":    true,
+}
+
+type bundleFile struct {
+	Path        string
+	Key         string
+	ContentType string
+	Size        int64
+}
+
+// ExportBundle writes pages, and the files uploaded to them, to w as a single
+// file: a zip of markdown, an html file with the files inlined, or an EPUB.
+// Links between the pages are kept, and links to pages which are not in the
+// bundle become plain text. The title names the bundle. Files are read from
+// storage as they are written, and ErrBundleTooLarge is returned, before
+// anything is written, when there is too much to export at once.
+func ExportBundle(ctx context.Context, pages []Page, blobs BlobStore, format, title string, w io.Writer) error {
+	if format != BundleMarkdown && format != BundleHTML && format != BundleEPUB {
+		return ErrUnknownBundle
+	}
+	if len(pages) > maxBundlePages {
+		return ErrBundleTooLarge
+	}
+	files, err := bundleFiles(ctx, pages, blobs)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, page := range pages {
+		size += int64(len(page.Body))
+	}
+	for _, file := range files {
+		size += file.Size
+	}
+	if size > maxBundleSize {
+		return ErrBundleTooLarge
+	}
+
+	switch format {
+	case BundleHTML:
+		return htmlBundle(ctx, pages, files, blobs, title, w)
+	case BundleEPUB:
+		return epubBundle(ctx, pages, files, blobs, title, w)
+	}
+	return markdownBundle(ctx, pages, files, blobs, w)
+}
+
+// BundleName is the name of the file pages exported from pagePath are sent as.
+func BundleName(pagePath, format string) string {
+	name := path.Base(pagePath)
+	if name == "/" || name == "." {
+		name = "wikie"
+	}
+	return name + "." + format
+}
+
+// bundleFiles finds every file uploaded to the pages.
+func bundleFiles(ctx context.Context, pages []Page, blobs BlobStore) (map[string]bundleFile, error) {
+	files := make(map[string]bundleFile)
+	for _, page := range pages {
+		namespace := StorageKey(page.Path)
+		infos, err := blobs.List(ctx, namespace+"/")
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if path.Dir(info.Key) != namespace {
+				continue
+			}
+			r, _, err := blobs.Open(ctx, info.Key)
+			if err == ErrBlobNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			contentType, err := SniffContentType(info.Key, r)
+			r.Close()
+			if err != nil {
+				return nil, err
+			}
+			files["/"+info.Key] = bundleFile{Path: "/" + info.Key, Key: info.Key, ContentType: contentType, Size: info.Size}
+		}
+	}
+	return files, nil
+}
+
+// writeBlob copies the file at key to w.
+func writeBlob(ctx context.Context, blobs BlobStore, key string, w io.Writer) error {
+	r, _, err := blobs.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// relativePath is the path of target, relative to the directory dir. Both
+// are slash separated and relative to the same root.
+func relativePath(dir, target string) string {
+	from := strings.Split(strings.Trim(path.Clean("/"+dir), "/"), "/")
+	to := strings.Split(strings.Trim(target, "/"), "/")
+	if from[0] == "" {
+		from = nil
+	}
+	i := 0
+	for i < len(from) && i < len(to)-1 && from[i] == to[i] {
+		i++
+	}
+	return strings.Repeat("../", len(from)-i) + strings.Join(to[i:], "/")
+}
+
+// markdownBundle writes a zip of the pages as markdown files, alongside the
+// files uploaded to them.
+func markdownBundle(ctx context.Context, pages []Page, files map[string]bundleFile, blobs BlobStore, w io.Writer) error {
+	included := make(map[string]bool)
+	for _, page := range pages {
+		included[page.Path] = true
+	}
+
+	zw := zip.NewWriter(w)
+	for _, page := range pages {
+		name := gitFile(page.Path)
+		dir := path.Dir(name)
+		page.Body = string(rewriteMarkdownLinks([]byte(page.Body), func(target string) string {
+			u, err := url.Parse(target)
+			if err != nil {
+				return target
+			}
+			switch kind, linked := resolveLink(u, page.Path); kind {
+			case linkPage:
+				if included[linked] {
+					return (&url.URL{Path: relativePath(dir, gitFile(linked)), Fragment: u.Fragment}).String()
+				}
+			case linkFile:
+				if _, ok := files[linked]; ok {
+					return (&url.URL{Path: relativePath(dir, StorageKey(linked)), Fragment: u.Fragment}).String()
+				}
+			}
+			return target
+		}))
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: page.LastUpdated})
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(encodeGitPage(page))
+		if err != nil {
+			return err
+		}
+	}
+	for _, file := range sortedFiles(files) {
+		f, err := zw.Create(file.Key)
+		if err != nil {
+			return err
+		}
+		err = writeBlob(ctx, blobs, file.Key, f)
+		if err == ErrBlobNotFound {
+			// Deleted since it was found; its entry is left empty.
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func sortedFiles(files map[string]bundleFile) []bundleFile {
+	var sorted []bundleFile
+	for _, file := range files {
+		sorted = append(sorted, file)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	return sorted
+}
+
+// bundleID is the id of the section of a page in a bundle.
+func bundleID(pagePath string) string {
+	return "page" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '-'
+	}, pagePath)
+}
+
+type bundleSection struct {
+	ID       string
+	Title    string
+	Path     string
+	Depth    int
+	Body     htmltemplate.HTML
+	EditedBy string
+	Updated  time.Time
+}
+
+// htmlBundle writes the pages as one html file, with the files they link to
+// inlined. Each page is written as it is rendered, so that only the files of
+// one page are held at once.
+func htmlBundle(ctx context.Context, pages []Page, files map[string]bundleFile, blobs BlobStore, title string, w io.Writer) error {
+	included := make(map[string]bool)
+	var sections []bundleSection
+	for _, page := range pages {
+		included[page.Path] = true
+		sections = append(sections, bundleSection{
+			ID:    bundleID(page.Path),
+			Title: page.title(),
+			Path:  page.Path,
+			Depth: strings.Count(strings.Trim(page.Path, "/"), "/"),
+		})
+	}
+	err := htmlBundleTemplate.ExecuteTemplate(w, "head", struct {
+		Title    string
+		Sections []bundleSection
+		Exported time.Time
+	}{title, sections, time.Now()})
+	if err != nil {
+		return err
+	}
+
+	for i, page := range pages {
+		var readErr error
+		body := rewriteLinks(string(page.Render()), page.Path, func(target, fragment string) (string, bool) {
+			return "#" + bundleID(target), included[target]
+		}, func(target string) (string, bool) {
+			file, ok := files[target]
+			if !ok || file.Size > maxInlineFile || readErr != nil {
+				return "", false
+			}
+			var b strings.Builder
+			b.WriteString("data:" + mediaType(file.ContentType) + ";base64,")
+			enc := base64.NewEncoder(base64.StdEncoding, &b)
+			err := writeBlob(ctx, blobs, file.Key, enc)
+			if err == ErrBlobNotFound {
+				return "", false
+			} else if err != nil {
+				readErr = err
+				return "", false
+			}
+			enc.Close()
+			return b.String(), true
+		})
+		if readErr != nil {
+			return readErr
+		}
+		section := sections[i]
+		section.Body, section.EditedBy, section.Updated = htmltemplate.HTML(body), page.EditedBy, page.LastUpdated
+		err := htmlBundleTemplate.ExecuteTemplate(w, "section", section)
+		if err != nil {
+			return err
+		}
+	}
+	return htmlBundleTemplate.ExecuteTemplate(w, "foot", nil)
+}
+
+// epubBundle writes the pages as an EPUB 3 book, one chapter for each page.
+func epubBundle(ctx context.Context, pages []Page, files map[string]bundleFile, blobs BlobStore, title string, w io.Writer) error {
+	chapters := make(map[string]string)
+	for i, page := range pages {
+		chapters[page.Path] = fmt.Sprintf("page%d.xhtml", i+1)
+	}
+
+	zw := zip.NewWriter(w)
+	// The type of the book comes first, uncompressed.
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, "application/epub+zip")
+	if err != nil {
+		return err
+	}
+	err = writeZipFile(zw, "META-INF/container.xml", []byte(epubContainer))
+	if err != nil {
+		return err
+	}
+
+	var sections []bundleSection
+	images := make(map[string]bundleFile)
+	for _, page := range pages {
+		body := rewriteLinks(string(page.Render()), page.Path, func(target, fragment string) (string, bool) {
+			chapter, ok := chapters[target]
+			if len(fragment) > 0 {
+				chapter += "#" + fragment
+			}
+			return chapter, ok
+		}, func(target string) (string, bool) {
+			file, ok := files[target]
+			if !ok || !epubTypes[mediaType(file.ContentType)] || file.Size > maxInlineFile {
+				return "", false
+			}
+			images[target] = file
+			return "files/" + file.Key, true
+		})
+		body, err = xhtml(body)
+		if err != nil {
+			return err
+		}
+		var chapter bytes.Buffer
+		err = epubChapterTemplate.Execute(&chapter, struct {
+			Title string
+			Body  string
+		}{page.title(), body})
+		if err != nil {
+			return err
+		}
+		err = writeZipFile(zw, "OEBPS/"+chapters[page.Path], chapter.Bytes())
+		if err != nil {
+			return err
+		}
+		sections = append(sections, bundleSection{ID: chapters[page.Path], Title: page.title(), Path: page.Path})
+	}
+
+	var manifest []bundleFile
+	for _, file := range sortedFiles(images) {
+		f, err := zw.Create("OEBPS/files/" + file.Key)
+		if err != nil {
+			return err
+		}
+		err = writeBlob(ctx, blobs, file.Key, f)
+		if err != nil && err != ErrBlobNotFound {
+			return err
+		}
+		file.ContentType = mediaType(file.ContentType)
+		manifest = append(manifest, file)
+	}
+
+	// A random (version 4) UUID identifies the book.
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return err
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	for name, t := range map[string]*template.Template{"OEBPS/content.opf": epubPackageTemplate, "OEBPS/nav.xhtml": epubNavTemplate} {
+		var b bytes.Buffer
+		err = t.Execute(&b, struct {
+			ID       string
+			Title    string
+			Modified string
+			Sections []bundleSection
+			Files    []bundleFile
+		}{fmt.Sprintf("%x-%x-%x-%x-%x", id[:4], id[4:6], id[6:8], id[8:10], id[10:]), title, time.Now().UTC().Format("2006-01-02T15:04:05Z"), sections, manifest})
+		if err != nil {
+			return err
+		}
+		err = writeZipFile(zw, name, b.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeZipFile(zw *zip.Writer, name string, b []byte) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	return err
+}
+
+// xhtml makes a fragment of html well formed, as EPUB readers require.
+func xhtml(fragment string) (string, error) {
+	nodes, err := html.ParseFragment(strings.NewReader(fragment), &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	for _, node := range nodes {
+		err := html.Render(&b, node)
+		if err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// xmlEscape escapes text for the XML files of an EPUB.
+func xmlEscape(s string) string {
+	return html.EscapeString(s)
+}
+
+// htmlBundleTemplate writes an html bundle in parts: the head, then each
+// section as it is rendered, then the foot.
+var htmlBundleTemplate = htmltemplate.Must(htmltemplate.New("bundle").Funcs(htmltemplate.FuncMap{
+	"indent": func(depth int) htmltemplate.CSS {
+		return htmltemplate.CSS(fmt.Sprintf("padding-left: %dem", depth))
+	},
+}).Parse(`{{ define "head" }}<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>{{ .Title }}</title>
+    <style>
+        body { max-width: 960px; margin: 0 auto; padding: 32px; font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; line-height: 1.5; color: #111; }
+        nav ul { list-style: none; padding: 0; }
+        section { border-top: 1px solid #ddd; margin-top: 32px; }
+        img { max-width: 100%; }
+        pre { overflow-x: auto; background: #f6f6f6; padding: 8px; }
+        @media print { section { page-break-before: always; border: none; } }
+    </style>
+</head>
+<body>
+<header>
+    <h1>{{ .Title }}</h1>
+    <small>Exported from wikie on {{ .Exported.Format "2 January 2006" }}.</small>
+</header>
+<nav>
+    <ul>
+        {{ range .Sections }}<li style="{{ indent .Depth }}"><a href="#{{ .ID }}">{{ .Title }}</a> <small>{{ .Path }}</small></li>{{ end }}
+    </ul>
+</nav>
+{{ end }}{{ define "section" }}
+<section id="{{ .ID }}">
+    {{ .Body }}
+    <p><small>{{ .Path }}, last edit by <em>{{ .EditedBy }}</em> on {{ .Updated.Format "2 January 2006" }}.</small></p>
+</section>
+{{ end }}{{ define "foot" }}</body>
+</html>
+{{ end }}`))
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+    <rootfiles>
+        <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+    </rootfiles>
+</container>
+`
+
+var epubFuncs = template.FuncMap{"xml": xmlEscape}
+
+var epubPackageTemplate = template.Must(template.New("content.opf").Funcs(epubFuncs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+    <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+        <dc:identifier id="id">urn:uuid:{{ .ID }}</dc:identifier>
+        <dc:title>{{ xml .Title }}</dc:title>
+        <dc:language>en</dc:language>
+        <meta property="dcterms:modified">{{ .Modified }}</meta>
+    </metadata>
+    <manifest>
+        <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+        {{ range .Sections }}<item id="{{ .ID }}" href="{{ .ID }}" media-type="application/xhtml+xml"/>
+        {{ end }}{{ range $i, $file := .Files }}<item id="file{{ $i }}" href="files/{{ xml $file.Key }}" media-type="{{ $file.ContentType }}"/>
+        {{ end }}
+    </manifest>
+    <spine>
+        {{ range .Sections }}<itemref idref="{{ .ID }}"/>
+        {{ end }}
+    </spine>
+</package>
+`))
+
+var epubNavTemplate = template.Must(template.New("nav.xhtml").Funcs(epubFuncs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>{{ xml .Title }}</title></head>
+<body>
+<nav epub:type="toc">
+    <h1>{{ xml .Title }}</h1>
+    <ol>
+        {{ range .Sections }}<li><a href="{{ .ID }}">{{ xml .Title }}</a></li>
+        {{ end }}
+    </ol>
+</nav>
+</body>
+</html>
+`))
+
+var epubChapterTemplate = template.Must(template.New("chapter").Funcs(epubFuncs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>{{ xml .Title }}</title></head>
+<body>
+{{ .Body }}
+</body>
+</html>
+`))
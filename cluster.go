@@ -0,0 +1,118 @@
+package wikie
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/olivere/elastic/v7"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DistributionElasticsearch = "elasticsearch"
+	DistributionOpenSearch    = "opensearch"
+)
+
+// supportedVersions are the major versions of each distribution that wikie
+// works with. All of them accept the typeless APIs used by the client.
+var supportedVersions = map[string][]int{
+	DistributionElasticsearch: {7, 8},
+	DistributionOpenSearch:    {1, 2, 3},
+}
+
+// Cluster is the distribution and version reported by a search cluster.
+type Cluster struct {
+	Distribution string
+	Version      string
+	Major        int
+}
+
+func (c Cluster) String() string {
+	return fmt.Sprintf("%s %s", c.Distribution, c.Version)
+}
+
+// DetectCluster asks the first reachable host which distribution and version
+// of the search engine it is running.
+func DetectCluster(config ElasticsearchConfig) (Cluster, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	var lastErr error
+	for _, host := range config.Hosts {
+		req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(host, "/")+"/", nil)
+		if err != nil {
+			return Cluster{}, err
+		}
+		if len(config.Username) > 0 {
+			req.SetBasicAuth(config.Username, config.Password)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var info struct {
+			Version struct {
+				Number       string `json:"number"`
+				Distribution string `json:"distribution"`
+			} `json:"version"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&info)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("%s responded with %s", host, resp.Status)
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		cluster := Cluster{
+			Distribution: info.Version.Distribution,
+			Version:      info.Version.Number,
+		}
+		if len(cluster.Distribution) == 0 {
+			cluster.Distribution = DistributionElasticsearch
+		}
+		cluster.Major, err = strconv.Atoi(strings.SplitN(cluster.Version, ".", 2)[0])
+		if err != nil {
+			return Cluster{}, fmt.Errorf("%s reported an unknown version %q", host, cluster.Version)
+		}
+		return cluster, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no elasticsearch hosts are configured")
+	}
+	return Cluster{}, lastErr
+}
+
+// NewClient connects to the configured search cluster, first checking that it
+// is the configured distribution and a version that wikie supports.
+func NewClient(config ElasticsearchConfig) (*elastic.Client, Cluster, error) {
+	cluster, err := DetectCluster(config)
+	if err != nil {
+		return nil, Cluster{}, err
+	}
+
+	if cluster.Distribution != config.Distribution {
+		return nil, cluster, fmt.Errorf("the cluster is running %s but the configured distribution is %s", cluster, config.Distribution)
+	}
+	supported := false
+	var versions []string
+	for _, major := range supportedVersions[cluster.Distribution] {
+		supported = supported || major == cluster.Major
+		versions = append(versions, strconv.Itoa(major)+".x")
+	}
+	if !supported {
+		return nil, cluster, fmt.Errorf("%s is not supported; wikie requires %s %s", cluster, cluster.Distribution, strings.Join(versions, " or "))
+	}
+
+	options := []elastic.ClientOptionFunc{elastic.SetURL(config.Hosts...)}
+	if len(config.Username) > 0 {
+		options = append(options, elastic.SetBasicAuth(config.Username, config.Password))
+	}
+	client, err := elastic.NewClient(options...)
+	return client, cluster, err
+}
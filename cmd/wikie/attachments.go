@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ielab/wikie"
+	"path"
+	"time"
+)
+
+// indexAttachment extracts the text of an uploaded file and indexes it so it
+// can be found by search. Files whose text cannot be extracted are skipped.
+func (s server) indexAttachment(filePath, user string) error {
+	f, _, err := s.blobs.Open(context.Background(), wikie.StorageKey(filePath))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	text, err := wikie.ExtractText(filePath, f)
+	if err == wikie.ErrUnsupportedAttachment {
+		return nil
+	} else if err != nil {
+		// A file we cannot parse is still a valid upload.
+		fmt.Println(err)
+		return nil
+	}
+
+	return wikie.IndexAttachment(s.esClient, wikie.Attachment{
+		Path:        filePath,
+		Page:        path.Dir(filePath),
+		Name:        path.Base(filePath),
+		Body:        text,
+		LastUpdated: time.Now(),
+		EditedBy:    user,
+	})
+}
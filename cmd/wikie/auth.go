@@ -2,17 +2,52 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/ielab/wikie"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 )
 
+// sessionLifetime is how long a login lasts, the age of the session cookie.
+const sessionLifetime = 30 * 24 * time.Hour
+
+// loginSet holds the tokens of the logins which have not been revoked. It is
+// read by every request, and changed by logging in and out and by revoking.
+type loginSet struct {
+	sync.RWMutex
+	tokens map[string]bool
+}
+
+func newLoginSet() *loginSet {
+	return &loginSet{tokens: make(map[string]bool)}
+}
+
+func (l *loginSet) has(token string) bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.tokens[token]
+}
+
+func (l *loginSet) add(token string) {
+	l.Lock()
+	l.tokens[token] = true
+	l.Unlock()
+}
+
+func (l *loginSet) remove(token string) {
+	l.Lock()
+	delete(l.tokens, token)
+	l.Unlock()
+}
+
 func randState() string {
 	b := make([]byte, 32)
 	rand.Read(b)
@@ -21,7 +56,14 @@ func randState() string {
 
 func (s server) logout(c *gin.Context) {
 	session := sessions.Default(c)
-	delete(s.sessions, session.Get("token").(string))
+	token := session.Get("token").(string)
+	s.sessions.remove(token)
+	_, err := wikie.RemoveSessions(s.permissionDB, func(login wikie.Session) bool {
+		return login.Token == token
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
 	session.Clear()
 	session.Save()
 	c.Redirect(http.StatusTemporaryRedirect, "/")
@@ -60,7 +102,11 @@ func (s server) loginRocket(c *gin.Context) {
 	session.Set("token", token)
 	session.Set("username", f["username"])
 	session.Save()
-	s.sessions[token] = true
+	s.sessions.add(token)
+	err = wikie.AddSession(s.permissionDB, token, fmt.Sprint(f["username"]))
+	if err != nil {
+		fmt.Println(err)
+	}
 	c.Request.Method = "GET"
 	c.Redirect(http.StatusFound, "/w/home")
 	return
@@ -111,7 +157,11 @@ func (s server) loginOAuth2Callback(c *gin.Context) {
 		session.Set("token", token)
 		session.Set("username", userInfo["email"])
 		session.Save()
-		s.sessions[token] = true
+		s.sessions.add(token)
+		err = wikie.AddSession(s.permissionDB, token, fmt.Sprint(userInfo["email"]))
+		if err != nil {
+			fmt.Println(err)
+		}
 		c.Redirect(http.StatusFound, "/w/home")
 		return
 	}
@@ -119,3 +169,73 @@ func (s server) loginOAuth2Callback(c *gin.Context) {
 	c.Redirect(http.StatusFound, "/")
 	return
 }
+
+type sessionsPage struct {
+	Sessions []wikie.Session
+	// Current is the admin's own login.
+	Current string
+}
+
+// sessionsView lists every login to an admin, so they can be revoked while
+// the wiki runs.
+func (s server) sessionsView(c *gin.Context) {
+	session := sessions.Default(c)
+	token := session.Get("token")
+	if token == nil {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	if !s.sessions.has(token.(string)) {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	if !s.isAdmin(session.Get("username").(string)) {
+		c.HTML(http.StatusForbidden, "forbidden.html", nil)
+		return
+	}
+
+	logins, err := wikie.GetSessions(s.permissionDB)
+	if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.HTML(http.StatusOK, "sessions.html", sessionsPage{Sessions: logins, Current: token.(string)})
+}
+
+// sessionsAction revokes a login, or every login of a user, logging them out
+// straight away.
+func (s server) sessionsAction(c *gin.Context) {
+	session := sessions.Default(c)
+	token := session.Get("token")
+	if token == nil {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	if !s.sessions.has(token.(string)) {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	if !s.isAdmin(session.Get("username").(string)) {
+		c.HTML(http.StatusForbidden, "forbidden.html", nil)
+		return
+	}
+
+	revoke, user := c.PostForm("token"), c.PostForm("user")
+	if len(revoke) == 0 && len(user) == 0 {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	revoked, err := wikie.RemoveSessions(s.permissionDB, func(login wikie.Session) bool {
+		return login.Token == revoke || (len(user) > 0 && login.User == user)
+	})
+	if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	for _, login := range revoked {
+		s.sessions.remove(login.Token)
+	}
+	c.Redirect(http.StatusFound, "/sessions")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/go-errors/errors"
+	"github.com/ielab/wikie"
+	"github.com/olivere/elastic/v7"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// errDBInUse is returned by openDB while the wiki is running.
+var errDBInUse = errors.New("perms.db is in use by a running wikie, stop it first")
+
+// openDB opens the permission database for a command. The server keeps it
+// locked while it runs, even against readers, so rather than waiting forever,
+// say what to do.
+func openDB(readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(dataPath("perms.db"), 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return nil, errDBInUse
+	} else if err != nil || readOnly {
+		return db, err
+	}
+	// The database may be new, or from before some of it was added.
+	err = wikie.Init(db, nil)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// backup writes a backup of the whole wiki to the file given by -out. While
+// the wiki is running, it has the database, so the backup is downloaded from
+// it instead.
+func backup(esClient *elastic.Client, config wikie.Config, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := flags.String("out", "wikie-"+time.Now().Format("20060102-150405")+".tar.gz", "file to write the backup to, or - for stdout")
+	server := flags.String("server", "http://localhost:"+config.Port, "address of the running wiki, to download the backup from")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	blobs, err := wikie.NewBlobStore(config.StorageConfig)
+	if err != nil {
+		return err
+	}
+	db, err := openDB(true)
+	if err == nil {
+		defer db.Close()
+	} else if err != errDBInUse {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	log := io.Writer(os.Stdout)
+	if *out == "-" {
+		log = os.Stderr
+	} else {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if db == nil {
+		fmt.Fprintf(log, "wikie is running, downloading the backup from %s\n", *server)
+		err = downloadBackup(*server, config.CookieSecret, w)
+	} else {
+		err = wikie.Backup(context.Background(), esClient, db, blobs, w, log)
+	}
+	if err != nil {
+		return err
+	}
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		err = f.Sync()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(log, "wrote %s\n", *out)
+	}
+	return nil
+}
+
+// downloadBackup writes a backup made by the wiki running at server to w. The
+// archive is checked as it is written, as the wiki can only stop sending it
+// if something goes wrong part way through.
+func downloadBackup(server, secret string, w io.Writer) error {
+	if len(secret) == 0 {
+		return fmt.Errorf("the configuration has no cookieSecret to sign the request with")
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(server, "/")+"/backup", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+wikie.BackupToken(secret, time.Now()))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading the backup: %s", resp.Status)
+	}
+	gz, err := gzip.NewReader(io.TeeReader(resp.Body, w))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, gz)
+	if err != nil {
+		return fmt.Errorf("downloading the backup: %v", err)
+	}
+	return nil
+}
+
+// restore restores the backup in the file given in args.
+func restore(esClient *elastic.Client, config wikie.Config, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "check the backup and show what would be restored without changing anything")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: wikie restore [-dry-run] <backup.tar.gz>")
+	}
+
+	var r io.Reader = os.Stdin
+	if flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if !*dryRun {
+		err = wikie.CreateIndices(esClient, config.ElasticsearchConfig, os.Stdout)
+		if err != nil {
+			return err
+		}
+	}
+	blobs, err := wikie.NewBlobStore(config.StorageConfig)
+	if err != nil {
+		return err
+	}
+	db, err := openDB(*dryRun)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return wikie.Restore(context.Background(), esClient, db, blobs, r, *dryRun, os.Stdout)
+}
+
+// backupDownload streams a backup of the running wiki to an admin, or to the
+// backup command, which signs its request with the cookie secret.
+func (s server) backupDownload(c *gin.Context) {
+	if auth := c.GetHeader("Authorization"); len(auth) > 0 {
+		if !wikie.CheckBackupToken(s.config.CookieSecret, strings.TrimPrefix(auth, "Bearer "), time.Now()) {
+			c.Status(http.StatusUnauthorized)
+			return
+		}
+		s.sendBackup(c)
+		return
+	}
+
+	session := sessions.Default(c)
+	token := session.Get("token")
+	if token == nil {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	if !s.sessions.has(token.(string)) {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	if !s.isAdmin(session.Get("username").(string)) {
+		c.HTML(http.StatusForbidden, "forbidden.html", nil)
+		return
+	}
+	s.sendBackup(c)
+}
+
+func (s server) sendBackup(c *gin.Context) {
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", `attachment; filename="wikie-`+time.Now().Format("20060102-150405")+`.tar.gz"`)
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	err := wikie.Backup(c.Request.Context(), s.esClient, s.permissionDB, s.blobs, c.Writer, ioutil.Discard)
+	if err != nil {
+		// The response has started, so the most that can be done is to
+		// leave the archive incomplete.
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/ielab/wikie"
+	"net/http"
+	"path"
+)
+
+var bundleTypes = map[string]string{
+	wikie.BundleMarkdown: "application/zip",
+	wikie.BundleHTML:     "text/html; charset=utf-8",
+	wikie.BundleEPUB:     "application/epub+zip",
+}
+
+// exportBundle sends a page, or the pages under it with ?scope=namespace, as
+// a single file in the ?format requested. Pages the user cannot read are left
+// out.
+func (s server) exportBundle(c *gin.Context) {
+	session := sessions.Default(c)
+	token := session.Get("token")
+	if token == nil {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	if !s.sessions.has(token.(string)) {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	user := session.Get("username").(string)
+
+	format := c.DefaultQuery("format", wikie.BundleMarkdown)
+	contentType, ok := bundleTypes[format]
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	pagePath := path.Clean("/" + c.Param("page"))
+	var pages []wikie.Page
+	switch c.DefaultQuery("scope", "page") {
+	case "page":
+		page, err := wikie.GetPage(s.esClient, pagePath)
+		if err == nil {
+			pages = append(pages, page)
+		}
+	case "namespace":
+		var err error
+		pages, err = wikie.AllPages(s.esClient, []string{pagePath}, false)
+		if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+	default:
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	var readable []wikie.Page
+	for _, page := range pages {
+		ok, err := wikie.HasPermission(s.permissionDB, user, page.Path, wikie.PermissionRead)
+		if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			readable = append(readable, page)
+		}
+	}
+	if len(readable) == 0 {
+		c.HTML(http.StatusNotFound, "forbidden.html", nil)
+		return
+	}
+
+	title := pagePath
+	if len(readable) == 1 && readable[0].Path == pagePath && len(readable[0].Title) > 0 {
+		title = readable[0].Title
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, wikie.BundleName(pagePath, format)))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	err := wikie.ExportBundle(c.Request.Context(), readable, s.blobs, format, title, c.Writer)
+	if err == wikie.ErrBundleTooLarge && !c.Writer.Written() {
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.Header("Content-Disposition", "")
+		c.String(http.StatusRequestEntityTooLarge, "There is too much to export at once; export fewer pages.")
+		return
+	} else if err != nil {
+		// The response has started, so the most that can be done is to
+		// leave the file incomplete.
+		fmt.Println(err)
+	}
+}
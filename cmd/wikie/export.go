@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/ielab/wikie"
+	"github.com/olivere/elastic/v7"
+	"os"
+)
+
+// exportStatic writes a static html site of the namespaces given in args, or
+// of every public page when none are.
+func exportStatic(esClient *elastic.Client, config wikie.Config, args []string) error {
+	flags := flag.NewFlagSet("export-static", flag.ContinueOnError)
+	out := flags.String("out", "site", "directory to write the site to")
+	publicOnly := flags.Bool("public", false, "only export public pages of the namespaces")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	namespaces := flags.Args()
+
+	blobs, err := wikie.NewBlobStore(config.StorageConfig)
+	if err != nil {
+		return err
+	}
+	pages, err := wikie.AllPages(esClient, namespaces, *publicOnly || len(namespaces) == 0)
+	if err != nil {
+		return err
+	}
+
+	// Files left unpublished stay off a public site, as they do on /public.
+	var published func(string) bool
+	if *publicOnly || len(namespaces) == 0 {
+		db, err := openDB(true)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		published = func(filePath string) bool {
+			history, err := wikie.GetFileHistory(db, filePath)
+			return err == nil && history.Public
+		}
+	}
+	return wikie.ExportStatic(context.Background(), pages, blobs, published, *out, os.Stdout)
+}
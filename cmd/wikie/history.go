@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/ielab/wikie"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+type historyPage struct {
+	Page    wikie.Page
+	History wikie.PageHistory
+	// Revision is the revision being viewed, if any.
+	Revision *wikie.PageRevision
+	Body     template.HTML
+}
+
+// pageHistory lists the revisions of a page, showing one when ?history is
+// given its version.
+func (s server) pageHistory(c *gin.Context, page wikie.Page) {
+	history, err := wikie.GetPageHistory(s.permissionDB, page.Path)
+	if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	page.Location = s.location(sessions.Default(c))
+	view := historyPage{Page: page, History: history}
+
+	if v := c.Query("history"); len(v) > 0 {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		revision, ok := history.Revision(version)
+		if !ok {
+			c.HTML(http.StatusNotFound, "forbidden.html", nil)
+			return
+		}
+		view.Revision = &revision
+		view.Body = wikie.Page{Path: page.Path, Body: revision.Body}.Render()
+	}
+	c.HTML(http.StatusOK, "history.html", view)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/ielab/wikie"
+	"github.com/olivere/elastic/v7"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// importPages imports pages from another format, named by the first of args.
+func importPages(esClient *elastic.Client, config wikie.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: wikie import markdown|mediawiki [flags] <source>")
+	}
+	switch args[0] {
+	case "markdown":
+		return importMarkdown(esClient, config, args[1:])
+	case "mediawiki":
+		return importMediaWiki(esClient, config, args[1:])
+	default:
+		return fmt.Errorf("unknown import format %s", args[0])
+	}
+}
+
+// isGitURL is whether source is a repository to clone rather than a directory.
+func isGitURL(source string) bool {
+	return strings.Contains(source, "://") || strings.HasPrefix(source, "git@")
+}
+
+// importMarkdown imports a directory of markdown files, or a git repository of them.
+func importMarkdown(esClient *elastic.Client, config wikie.Config, args []string) error {
+	flags := flag.NewFlagSet("import markdown", flag.ContinueOnError)
+	var opts wikie.ImportOptions
+	flags.StringVar(&opts.Prefix, "prefix", "/", "path to import the pages under")
+	flags.StringVar(&opts.User, "user", "import", "who pages are edited by when their history does not say")
+	flags.BoolVar(&opts.Overwrite, "overwrite", false, "replace pages which already exist")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "show what would be imported without changing anything")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: wikie import markdown [flags] <directory or git url>")
+	}
+
+	dir := flags.Arg(0)
+	if isGitURL(dir) {
+		dir, err = wikie.CloneGit(dir)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+	}
+
+	if !opts.DryRun {
+		err = wikie.CreateIndices(esClient, config.ElasticsearchConfig, os.Stdout)
+		if err != nil {
+			return err
+		}
+	}
+	blobs, err := wikie.NewBlobStore(config.StorageConfig)
+	if err != nil {
+		return err
+	}
+	db, err := openDB(opts.DryRun)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report, err := wikie.ImportMarkdown(context.Background(), esClient, db, blobs, dir, opts, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if len(report.Conflicts) > 0 && !opts.Overwrite {
+		fmt.Println("run again with -overwrite to replace the pages which already exist")
+	}
+	return nil
+}
+
+// namespaceFlag collects -namespace Name=/path flags.
+type namespaceFlag map[string]string
+
+func (n namespaceFlag) String() string {
+	return fmt.Sprint(map[string]string(n))
+}
+
+func (n namespaceFlag) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("namespaces are mapped as Name=/path")
+	}
+	n[v[:i]] = v[i+1:]
+	return nil
+}
+
+// importMediaWiki imports a MediaWiki XML export, which may be compressed.
+func importMediaWiki(esClient *elastic.Client, config wikie.Config, args []string) error {
+	flags := flag.NewFlagSet("import mediawiki", flag.ContinueOnError)
+	opts := wikie.MediaWikiOptions{Namespaces: make(namespaceFlag)}
+	flags.StringVar(&opts.Prefix, "prefix", "/", "path to import the pages under")
+	flags.BoolVar(&opts.Overwrite, "overwrite", false, "replace pages which already exist")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "show what would be imported without changing anything")
+	flags.StringVar(&opts.Files, "files", "", "images directory of the MediaWiki to upload files from")
+	flags.Var(namespaceFlag(opts.Namespaces), "namespace", "import a namespace to a path, as Name=/path (repeatable)")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: wikie import mediawiki [flags] <export.xml>")
+	}
+
+	var r io.Reader = os.Stdin
+	if name := flags.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+		switch filepath.Ext(name) {
+		case ".gz":
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				return err
+			}
+			r = gz
+		case ".bz2":
+			r = bzip2.NewReader(f)
+		}
+	}
+
+	if !opts.DryRun {
+		err = wikie.CreateIndices(esClient, config.ElasticsearchConfig, os.Stdout)
+		if err != nil {
+			return err
+		}
+	}
+	blobs, err := wikie.NewBlobStore(config.StorageConfig)
+	if err != nil {
+		return err
+	}
+	db, err := openDB(opts.DryRun)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report, err := wikie.ImportMediaWiki(context.Background(), esClient, db, blobs, r, opts, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if len(report.Conflicts) > 0 && !opts.Overwrite {
+		fmt.Println("run again with -overwrite to replace the pages which already exist")
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ielab/wikie"
+	"github.com/olivere/elastic/v7"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const usage = `usage: wikie [--config file] [--data-dir dir] <command> [args]
+
+commands:
+  serve                          run the wiki, the default
+  perms list|grant|revoke|check  manage who can read and write pages
+  pages list|get|put|delete      read and change pages
+  users list|remove              manage the users known to the wiki
+  sessions list|revoke           manage logins
+  reindex                        rebuild the search indices
+  backup, restore                back up or restore the whole wiki
+  import markdown|mediawiki      import pages from elsewhere
+  export-static                  write the public pages as an html site
+
+Commands which use the database, even only to read it, need the wiki to be
+stopped first, as it keeps the database locked while it runs. While it runs,
+backup downloads the backup from it instead, and logins can be revoked from
+/sessions by an admin.
+Listings are written one per line with tab separated fields, or as JSON
+with -json.
+
+flags:
+`
+
+// dataDir is the directory perms.db is kept in. Relative paths in the
+// configuration are relative to it too.
+var dataDir = "."
+
+// dataPath is where the file name is kept.
+func dataPath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dataDir, name)
+}
+
+// commands are the commands which only need the configuration.
+var commands = map[string]func(config wikie.Config, args []string) error{
+	"serve":    serve,
+	"perms":    perms,
+	"users":    users,
+	"sessions": loginSessions,
+}
+
+// searchCommands are the commands which need the search cluster.
+var searchCommands = map[string]func(esClient *elastic.Client, config wikie.Config, args []string) error{
+	"pages":         pages,
+	"reindex":       reindex,
+	"export-static": exportStatic,
+	"backup":        backup,
+	"restore":       restore,
+	"import":        importPages,
+}
+
+// exitStatus ends a command with a status but no message, for commands whose
+// output already says what happened.
+type exitStatus int
+
+func (e exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+func main() {
+	flags := flag.NewFlagSet("wikie", flag.ExitOnError)
+	configFile := flags.String("config", "config.yml", "configuration file")
+	flags.StringVar(&dataDir, "data-dir", ".", "directory perms.db and local storage are kept in")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	command, args := "serve", flags.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	if command == "help" {
+		flags.Usage()
+		return
+	}
+
+	config, err := wikie.ReadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if config.StorageConfig.Backend == "" || config.StorageConfig.Backend == "local" {
+		if len(config.StorageConfig.Path) == 0 {
+			config.StorageConfig.Path = "storage"
+		}
+		config.StorageConfig.Path = dataPath(config.StorageConfig.Path)
+	}
+	config.GitConfig.Path = dataPath(config.GitConfig.Path)
+
+	if run, ok := commands[command]; ok {
+		err = run(config, args)
+	} else if run, ok := searchCommands[command]; ok {
+		var esClient *elastic.Client
+		esClient, err = connect(config)
+		if err == nil {
+			err = run(esClient, config, args)
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "unknown command %s\n\n", command)
+		flags.Usage()
+		os.Exit(2)
+	}
+	if status, ok := err.(exitStatus); ok {
+		os.Exit(int(status))
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// connect connects to the search cluster.
+func connect(config wikie.Config) (*elastic.Client, error) {
+	esClient, cluster, err := wikie.NewClient(config.ElasticsearchConfig)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("connected to %s\n", cluster)
+	return esClient, nil
+}
+
+func reindex(esClient *elastic.Client, config wikie.Config, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("usage: wikie reindex")
+	}
+	return wikie.Reindex(esClient, config.ElasticsearchConfig, os.Stdout)
+}
+
+// list writes the rows of a listing with tab separated fields, or v as JSON
+// when asJSON.
+func list(asJSON bool, v interface{}, rows [][]string) error {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	for _, row := range rows {
+		fmt.Println(strings.Join(row, "\t"))
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/ielab/wikie"
+	"github.com/olivere/elastic/v7"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+type pageEntry struct {
+	Path     string    `json:"path"`
+	Title    string    `json:"title"`
+	Updated  time.Time `json:"updated"`
+	EditedBy string    `json:"edited"`
+	Public   bool      `json:"public"`
+	Tags     []string  `json:"tags"`
+}
+
+// pages reads and changes pages.
+func pages(esClient *elastic.Client, config wikie.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: wikie pages list|get|put|delete")
+	}
+	switch args[0] {
+	case "list":
+		return pagesList(esClient, args[1:])
+	case "get":
+		return pagesGet(esClient, args[1:])
+	case "put":
+		return pagesPut(esClient, config, args[1:])
+	case "delete":
+		return pagesDelete(esClient, config, args[1:])
+	default:
+		return fmt.Errorf("unknown pages command %s", args[0])
+	}
+}
+
+// pagePath cleans a path given to a command into the path of a page.
+func pagePath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func pagesList(esClient *elastic.Client, args []string) error {
+	flags := flag.NewFlagSet("pages list", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "write the pages as JSON")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	all, err := wikie.AllPages(esClient, flags.Args(), false)
+	if err != nil {
+		return err
+	}
+	entries := make([]pageEntry, 0, len(all))
+	var rows [][]string
+	for _, page := range all {
+		entries = append(entries, pageEntry{
+			Path:     page.Path,
+			Title:    page.Title,
+			Updated:  page.LastUpdated,
+			EditedBy: page.EditedBy,
+			Public:   page.Public,
+			Tags:     page.Tags,
+		})
+		rows = append(rows, []string{page.Path, page.Title, page.LastUpdated.Format(time.RFC3339), page.EditedBy})
+	}
+	return list(*asJSON, entries, rows)
+}
+
+// pagesGet writes the markdown of a page, or the whole page as JSON.
+func pagesGet(esClient *elastic.Client, args []string) error {
+	flags := flag.NewFlagSet("pages get", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "write the page as JSON")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: wikie pages get [-json] <path>")
+	}
+
+	page, err := wikie.GetPage(esClient, pagePath(flags.Arg(0)))
+	if elastic.IsNotFound(err) {
+		return fmt.Errorf("no page at %s", pagePath(flags.Arg(0)))
+	} else if err != nil {
+		return err
+	}
+	if *asJSON {
+		return list(true, page, nil)
+	}
+	_, err = io.WriteString(os.Stdout, page.Body)
+	return err
+}
+
+// pagesPut creates or replaces the markdown of a page, read from a file or stdin.
+func pagesPut(esClient *elastic.Client, config wikie.Config, args []string) error {
+	flags := flag.NewFlagSet("pages put", flag.ContinueOnError)
+	user := flags.String("user", "wikie", "who the page is edited by")
+	comment := flags.String("comment", "", "describe the edit in the history of the page")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return fmt.Errorf("usage: wikie pages put [-user name] [-comment text] <path> [file]")
+	}
+
+	var r io.Reader = os.Stdin
+	if flags.NArg() == 2 && flags.Arg(1) != "-" {
+		f, err := os.Open(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	p := pagePath(flags.Arg(0))
+	page, err := wikie.GetPage(esClient, p)
+	exists := err == nil
+	if err != nil && !elastic.IsNotFound(err) {
+		return err
+	}
+	page.Path = p
+	page.Body = string(body)
+	page.EditedBy = *user
+	page.LastUpdated = time.Now()
+	if exists {
+		err = wikie.UpdatePage(esClient, p, page)
+	} else {
+		err = wikie.NewPage(esClient, p, page)
+	}
+	if err != nil {
+		return err
+	}
+	err = wikie.AddPageRevisions(db, p, wikie.PageRevision{Body: page.Body, EditedBy: page.EditedBy, Updated: page.LastUpdated, Comment: *comment})
+	if err != nil {
+		return err
+	}
+
+	if config.GitConfig.Enabled {
+		git, err := wikie.OpenGitSync(esClient, db, config.GitConfig.Path, os.Stderr)
+		if err != nil {
+			return err
+		}
+		return git.SavePage(context.Background(), p)
+	}
+	return nil
+}
+
+// pagesDelete deletes a page. Its history and files are kept.
+func pagesDelete(esClient *elastic.Client, config wikie.Config, args []string) error {
+	flags := flag.NewFlagSet("pages delete", flag.ContinueOnError)
+	user := flags.String("user", "wikie", "who the page is deleted by")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: wikie pages delete [-user name] <path>")
+	}
+
+	p := pagePath(flags.Arg(0))
+	_, err = wikie.GetPage(esClient, p)
+	if elastic.IsNotFound(err) {
+		return fmt.Errorf("no page at %s", p)
+	} else if err != nil {
+		return err
+	}
+
+	if config.GitConfig.Enabled {
+		db, err := openDB(false)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		git, err := wikie.OpenGitSync(esClient, db, config.GitConfig.Path, os.Stderr)
+		if err != nil {
+			return err
+		}
+		// Removing it from git first applies anything pushed to the page,
+		// which would otherwise bring it back.
+		err = git.RemovePage(context.Background(), p, *user)
+		if err != nil {
+			return err
+		}
+	}
+	return wikie.DeletePage(esClient, p)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ielab/wikie"
+	"sort"
+	"strconv"
+)
+
+type permEntry struct {
+	User   string `json:"user"`
+	Path   string `json:"path"`
+	Access string `json:"access"`
+}
+
+// parseAccess reads the access level given to a command, as read, write or
+// its number.
+func parseAccess(s string) (wikie.AccessType, error) {
+	switch s {
+	case "read":
+		return wikie.PermissionRead, nil
+	case "write":
+		return wikie.PermissionWrite, nil
+	}
+	access, err := strconv.Atoi(s)
+	if err != nil || access <= 0 {
+		return 0, fmt.Errorf("access must be read, write or a number, not %s", s)
+	}
+	return wikie.AccessType(access), nil
+}
+
+func accessName(access wikie.AccessType) string {
+	switch access {
+	case wikie.PermissionRead:
+		return "read"
+	case wikie.PermissionWrite:
+		return "write"
+	}
+	return strconv.Itoa(int(access))
+}
+
+// perms lists and changes the permissions users have to pages.
+func perms(config wikie.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: wikie perms list|grant|revoke|check")
+	}
+	switch args[0] {
+	case "list":
+		return permsList(args[1:])
+	case "grant", "revoke":
+		return permsChange(args[0], args[1:])
+	case "check":
+		return permsCheck(args[1:])
+	default:
+		return fmt.Errorf("unknown perms command %s", args[0])
+	}
+}
+
+func permsList(args []string) error {
+	flags := flag.NewFlagSet("perms list", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "write the permissions as JSON")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("usage: wikie perms list [-json] [user]")
+	}
+
+	db, err := openDB(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	userPerms, err := wikie.GetPermissions(db)
+	if err != nil {
+		return err
+	}
+
+	var users []string
+	for user := range userPerms {
+		if flags.NArg() == 0 || user == flags.Arg(0) {
+			users = append(users, user)
+		}
+	}
+	sort.Strings(users)
+	entries := make([]permEntry, 0)
+	var rows [][]string
+	for _, user := range users {
+		for _, perm := range userPerms[user] {
+			entry := permEntry{User: user, Path: perm.Path, Access: accessName(perm.Access)}
+			entries = append(entries, entry)
+			rows = append(rows, []string{entry.User, entry.Path, entry.Access})
+		}
+	}
+	return list(*asJSON, entries, rows)
+}
+
+// permsChange grants or revokes a permission. Granting a permission the user
+// already has, or revoking one they do not, changes nothing.
+func permsChange(action string, args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("usage: wikie perms %s <user> <path> read|write", action)
+	}
+	user, permPath := args[0], args[1]
+	access, err := parseAccess(args[2])
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if action == "revoke" {
+		return wikie.RemovePermission(db, user, permPath, access)
+	}
+
+	userPerms, err := wikie.GetPermissions(db)
+	if err != nil {
+		return err
+	}
+	for _, perm := range userPerms[user] {
+		if perm.Path == permPath && perm.Access == access {
+			return nil
+		}
+	}
+	return wikie.AddPermission(db, user, permPath, access)
+}
+
+// permsCheck says whether a user may access a page, exiting with status 1
+// when they may not.
+func permsCheck(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("usage: wikie perms check <user> <path> read|write")
+	}
+	access, err := parseAccess(args[2])
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ok, err := wikie.HasPermission(db, args[0], args[1], access)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Println("denied")
+		return exitStatus(1)
+	}
+	fmt.Println("allowed")
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/ielab/wikie"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// templateFuncs are the functions available to the html templates.
+var templateFuncs = template.FuncMap{
+	"ago": func(t time.Time) string {
+		return wikie.RelativeTime(t, time.Now())
+	},
+	"localtime": wikie.LocalTime,
+	"size":      wikie.FormatSize,
+}
+
+type profilePage struct {
+	Username string
+	Profile  wikie.Profile
+	Now      time.Time
+	Location *time.Location
+	Error    string
+}
+
+func (s server) profileView(c *gin.Context) {
+	session := sessions.Default(c)
+	token := session.Get("token")
+	if token == nil {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	if !s.sessions.has(token.(string)) {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+
+	username := session.Get("username").(string)
+	profile, err := wikie.GetProfile(s.permissionDB, username)
+	if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.HTML(http.StatusOK, "profile.html", profilePage{username, profile, time.Now(), profile.Location(), ""})
+}
+
+func (s server) profile(c *gin.Context) {
+	session := sessions.Default(c)
+	token := session.Get("token")
+	if token == nil {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	if !s.sessions.has(token.(string)) {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+
+	username := session.Get("username").(string)
+	profile := wikie.Profile{Timezone: c.PostForm("timezone")}
+	err := wikie.SetProfile(s.permissionDB, username, profile)
+	if err == wikie.ErrUnknownTimezone {
+		c.HTML(http.StatusBadRequest, "profile.html", profilePage{username, profile, time.Now(), time.UTC, fmt.Sprintf("unknown timezone %q", profile.Timezone)})
+		return
+	} else if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/profile")
+}
+
+// location returns the time zone the signed in user prefers times shown in.
+func (s server) location(session sessions.Session) *time.Location {
+	username, ok := session.Get("username").(string)
+	if !ok {
+		return time.UTC
+	}
+	profile, err := wikie.GetProfile(s.permissionDB, username)
+	if err != nil {
+		fmt.Println(err)
+		return time.UTC
+	}
+	return profile.Location()
+}
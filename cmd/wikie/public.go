@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/ielab/wikie"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type publicPage struct {
+	wikie.Page
+	Body template.HTML
+}
+
+type publicIndexPage struct {
+	Index   []wikie.PageTreeEntry
+	Query   string
+	Results *wikie.SearchResults
+	Prev    int
+	Next    int
+}
+
+// publicCacheLifetime is how long the list of public pages is kept. Pages
+// saved through the wiki update it straight away, so this only delays pages
+// changed by other means, such as the wikie command.
+const publicCacheLifetime = time.Minute
+
+// publicCache holds the public pages, which every public view needs.
+type publicCache struct {
+	sync.Mutex
+	pages  []wikie.Suggestion
+	loaded time.Time
+}
+
+func newPublicCache() *publicCache {
+	return &publicCache{}
+}
+
+// publicPages returns every public page, and the set of their paths.
+func (s server) publicPages() ([]wikie.Suggestion, map[string]bool, error) {
+	s.public.Lock()
+	defer s.public.Unlock()
+	if s.public.loaded.IsZero() || time.Since(s.public.loaded) > publicCacheLifetime {
+		pages, err := wikie.PublicPages(s.esClient)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.public.pages, s.public.loaded = pages, time.Now()
+	}
+
+	public := make(map[string]bool)
+	for _, page := range s.public.pages {
+		public[page.Path] = true
+	}
+	return s.public.pages, public, nil
+}
+
+// publicSaved updates the public pages once the page at pagePath is saved.
+// The page is read back, as searches only see it once the index refreshes.
+func (s server) publicSaved(pagePath string) {
+	page, err := wikie.GetPage(s.esClient, pagePath)
+	s.public.Lock()
+	defer s.public.Unlock()
+	if err != nil {
+		fmt.Println(err)
+		s.public.loaded = time.Time{}
+		return
+	}
+	if s.public.loaded.IsZero() {
+		return
+	}
+
+	// The slice may have been handed out, so a new one is made.
+	var pages []wikie.Suggestion
+	for _, p := range s.public.pages {
+		if p.Path != pagePath {
+			pages = append(pages, p)
+		}
+	}
+	if page.Public {
+		pages = append(pages, wikie.Suggestion{Path: pagePath, Title: page.Title})
+		sort.Slice(pages, func(i, j int) bool {
+			return pages[i].Path < pages[j].Path
+		})
+	}
+	s.public.pages = pages
+}
+
+// publicExpired forgets the public pages, such as after they have been
+// changed by a git sync.
+func (s server) publicExpired() {
+	s.public.Lock()
+	s.public.loaded = time.Time{}
+	s.public.Unlock()
+}
+
+// publicView shows a public page to anyone, or the index of public pages.
+func (s server) publicView(c *gin.Context) {
+	pagePath := c.Param("page")
+	if len(pagePath) <= 1 {
+		s.publicIndex(c)
+		return
+	}
+	if pagePath[len(pagePath)-1] == '/' {
+		c.Redirect(http.StatusTemporaryRedirect, path.Join("/public", pagePath[:len(pagePath)-1]))
+		return
+	}
+
+	page, err := wikie.GetPage(s.esClient, pagePath)
+	if err != nil {
+		fmt.Println(err)
+		c.HTML(http.StatusForbidden, "forbidden.html", nil)
+		return
+	}
+	if !page.Public {
+		c.HTML(http.StatusForbidden, "forbidden.html", nil)
+		return
+	}
+
+	_, public, err := s.publicPages()
+	if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	page.Location = s.location(sessions.Default(c))
+	body := wikie.PublicLinks(string(page.Render()), page.Path, public, func(filePath string) bool {
+		history, err := wikie.GetFileHistory(s.permissionDB, filePath)
+		if err != nil {
+			fmt.Println(err)
+			return false
+		}
+		return history.Public
+	})
+	c.HTML(http.StatusOK, "public.html", publicPage{page, template.HTML(body)})
+}
+
+// publicIndex lists the public pages, or searches them.
+func (s server) publicIndex(c *gin.Context) {
+	q := c.Query("q")
+	if len(q) == 0 {
+		pages, _, err := s.publicPages()
+		if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.HTML(http.StatusOK, "publicindex.html", publicIndexPage{Index: wikie.PageTree(pages)})
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	if lastPage := maxSearchWindow / defaultSearchSize; page > lastPage {
+		page = lastPage
+	}
+	query := wikie.ParseSearchQuery(q)
+	query.Public = "true"
+	results, err := wikie.SearchPages(s.esClient, query, []string{"/"}, (page-1)*defaultSearchSize, defaultSearchSize)
+	if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	var prev, next int
+	if page > 1 {
+		prev = page - 1
+	}
+	if int64(page*defaultSearchSize) < results.Total && (page+1)*defaultSearchSize <= maxSearchWindow {
+		next = page + 1
+	}
+	c.HTML(http.StatusOK, "publicindex.html", publicIndexPage{Query: q, Results: &results, Prev: prev, Next: next})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/ielab/wikie"
+	"sync"
+)
+
+const (
+	// relatedCandidates is the number of related pages fetched for each page,
+	// before the ones the reader cannot see are removed.
+	relatedCandidates = 20
+	// relatedSize is the number of related pages shown on a page.
+	relatedSize = 5
+	// relatedCacheSize is the number of pages whose related pages are cached.
+	relatedCacheSize = 1024
+)
+
+type relatedEntry struct {
+	version int64
+	pages   []wikie.Suggestion
+}
+
+// relatedCache holds the related pages of each page, computed once per
+// revision of the page.
+type relatedCache struct {
+	sync.Mutex
+	entries map[string]relatedEntry
+}
+
+func newRelatedCache() *relatedCache {
+	return &relatedCache{entries: make(map[string]relatedEntry)}
+}
+
+// relatedPages returns the pages related to page which user is able to read.
+func (s server) relatedPages(page wikie.Page, user string) ([]wikie.Suggestion, error) {
+	s.related.Lock()
+	entry, ok := s.related.entries[page.Path]
+	s.related.Unlock()
+
+	if !ok || entry.version != page.Version {
+		candidates, err := wikie.RelatedPages(s.esClient, page.Path, relatedCandidates)
+		if err != nil {
+			return nil, err
+		}
+		entry = relatedEntry{version: page.Version, pages: candidates}
+
+		s.related.Lock()
+		if len(s.related.entries) >= relatedCacheSize {
+			s.related.entries = make(map[string]relatedEntry)
+		}
+		s.related.entries[page.Path] = entry
+		s.related.Unlock()
+	}
+
+	var pages []wikie.Suggestion
+	for _, candidate := range entry.pages {
+		ok, err := wikie.HasPermission(s.permissionDB, user, candidate.Path, wikie.PermissionRead)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			pages = append(pages, candidate)
+		}
+		if len(pages) == relatedSize {
+			break
+		}
+	}
+	return pages, nil
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/ielab/wikie"
-	"gopkg.in/olivere/elastic.v5"
 	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSearchSize = 10
+	maxSearchSize     = 100
+	// maxSearchWindow is how deep into the results elasticsearch will page,
+	// its index.max_result_window.
+	maxSearchWindow = 10000
 )
 
 func (s server) search(c *gin.Context) {
@@ -17,35 +25,118 @@ func (s server) search(c *gin.Context) {
 		c.Redirect(http.StatusTemporaryRedirect, "/")
 		return
 	}
-	if _, ok := s.sessions[token.(string)]; !ok {
+	if !s.sessions.has(token.(string)) {
 		c.Redirect(http.StatusTemporaryRedirect, "/")
 		return
 	}
 
-	if q := c.Query("q"); len(q) > 0 {
-		result, err := s.esClient.Search("wikie").Query(elastic.NewSimpleQueryStringQuery(q)).Do(context.Background())
+	query := wikie.ParseSearchQuery(c.Query("q"))
+	// Filters chosen in the search form are folded into the query, so that the
+	// query string alone describes the search for paging and facet links.
+	for _, key := range []string{"ns", "author", "tag", "public", "after", "before"} {
+		if v := c.Query(key); len(v) > 0 {
+			query = wikie.ParseSearchQuery(query.With(key, v))
+		}
+	}
+
+	if len(query.Text) > 0 || query.Filtered() {
+		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+		size, err := strconv.Atoi(c.DefaultQuery("size", strconv.Itoa(defaultSearchSize)))
+		if err != nil || size < 1 {
+			size = defaultSearchSize
+		} else if size > maxSearchSize {
+			size = maxSearchSize
+		}
+		if lastPage := maxSearchWindow / size; page > lastPage {
+			page = lastPage
+		}
+
+		readable, err := wikie.ReadablePaths(s.permissionDB, session.Get("username").(string))
+		if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+
+		results, err := wikie.SearchPages(s.esClient, query, readable, (page-1)*size, size)
 		if err != nil {
 			fmt.Println(err)
 			c.Status(http.StatusInternalServerError)
 			return
 		}
-		var pages []wikie.Page
-		for _, hit := range result.Hits.Hits {
-			page, err := wikie.GetPage(s.esClient, hit.Id)
-			if err != nil {
-				fmt.Println(err)
-				c.Status(http.StatusInternalServerError)
-				return
-			}
-			if ok, err := wikie.HasPermission(s.permissionDB, session.Get("username").(string), page.Path, wikie.PermissionRead); err == nil && ok {
-				pages = append(pages, page)
-			}
+
+		var prev, next int
+		if page > 1 {
+			prev = page - 1
+		}
+		if int64(page*size) < results.Total && (page+1)*size <= maxSearchWindow {
+			next = page + 1
 		}
+
 		c.HTML(http.StatusOK, "search.html", struct {
-			Pages []wikie.Page
-			Query string
-		}{pages, q})
+			wikie.SearchResults
+			Query  string
+			Search wikie.SearchQuery
+			Size   int
+			Prev   int
+			Next   int
+		}{results, query.String(), query, size, prev, next})
 		return
 	}
 	c.HTML(http.StatusOK, "search.html", nil)
 }
+
+func (s server) suggest(c *gin.Context) {
+	session := sessions.Default(c)
+	token := session.Get("token")
+	if token == nil {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+	if !s.sessions.has(token.(string)) {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	q := strings.TrimSpace(c.Query("q"))
+	if len(q) == 0 {
+		c.JSON(http.StatusOK, gin.H{"pages": []wikie.Suggestion{}})
+		return
+	}
+
+	username := session.Get("username").(string)
+	readable, err := wikie.ReadablePaths(s.permissionDB, username)
+	if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	suggestions, err := wikie.SuggestPages(s.esClient, q, readable)
+	if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if suggestions == nil {
+		suggestions = []wikie.Suggestion{}
+	}
+
+	// When nothing matches, offer to create the page at the typed path.
+	var create string
+	if len(suggestions) == 0 && !strings.ContainsAny(q, " \t") {
+		pagePath := "/" + strings.Trim(q, "/")
+		if ok, err := wikie.HasPermission(s.permissionDB, username, pagePath, wikie.PermissionWrite); err == nil && ok {
+			create = pagePath
+		} else if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"pages": suggestions, "create": create})
+}
@@ -1,23 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/boltdb/bolt"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
-	"github.com/h2non/filetype"
 	"github.com/ielab/wikie"
+	"github.com/olivere/elastic/v7"
 	"golang.org/x/oauth2"
-	"gopkg.in/olivere/elastic.v5"
-	"io/ioutil"
-	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -27,8 +23,16 @@ type server struct {
 	config       wikie.Config
 	esClient     *elastic.Client
 	permissionDB *bolt.DB
+	blobs        wikie.BlobStore
+	policy       wikie.StoragePolicy
 	oAuthConf    *oauth2.Config
-	sessions     map[string]bool
+	sessions     *loginSet
+	related      *relatedCache
+	public       *publicCache
+	git          *wikie.GitSync
+	// shareFailures and addressFailures count wrong share passwords.
+	shareFailures   *failureLimiter
+	addressFailures *failureLimiter
 }
 
 func (s server) hasPermissions(db *bolt.DB, user string) (bool, error) {
@@ -44,31 +48,48 @@ func (s server) hasPermissions(db *bolt.DB, user string) (bool, error) {
 	return true, nil
 }
 
-//noinspection GoUnhandledErrorResult
-func main() {
-	config, err := wikie.ReadConfig("config.yml")
+// serve runs the wiki.
+// noinspection GoUnhandledErrorResult
+func serve(config wikie.Config, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("usage: wikie serve")
+	}
+	esClient, err := connect(config)
+	if err != nil {
+		return err
+	}
+
+	err = wikie.CreateIndices(esClient, config.ElasticsearchConfig, os.Stdout)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	esClient, err := elastic.NewClient(elastic.SetURL(config.ElasticsearchConfig.Hosts...))
+	blobs, err := wikie.NewBlobStore(config.StorageConfig)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	policy, err := config.StorageConfig.Limits.Policy()
+	if err != nil {
+		return err
 	}
 
-	db, err := bolt.Open("perms.db", 0600, nil)
+	db, err := bolt.Open(dataPath("perms.db"), 0600, nil)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer db.Close()
 
-	wikie.Init(db, config.Admins)
+	err = wikie.Init(db, config.Admins)
+	if err != nil {
+		return err
+	}
 
 	store := cookie.NewStore([]byte(config.CookieSecret))
 	g := gin.Default()
 	// Session middleware.
 	g.Use(sessions.Sessions("wikie", store))
 
+	g.SetFuncMap(templateFuncs)
 	g.LoadHTMLGlob("web/*.html")
 	g.Static("/static/", "web/static")
 
@@ -76,7 +97,51 @@ func main() {
 		config:       config,
 		esClient:     esClient,
 		permissionDB: db,
-		sessions:     make(map[string]bool),
+		blobs:        blobs,
+		policy:       policy,
+		sessions:     newLoginSet(),
+		related:      newRelatedCache(),
+		public:       newPublicCache(),
+
+		shareFailures:   newFailureLimiter(maxShareFailures, sharePasswordWindow),
+		addressFailures: newFailureLimiter(maxAddressFailures, sharePasswordWindow),
+	}
+
+	// Logins last as long as their cookies.
+	_, err = wikie.RemoveSessions(db, func(session wikie.Session) bool {
+		return time.Since(session.Created) > sessionLifetime
+	})
+	if err != nil {
+		return err
+	}
+	logins, err := wikie.GetSessions(db)
+	if err != nil {
+		return err
+	}
+	for _, login := range logins {
+		s.sessions.add(login.Token)
+	}
+
+	if config.GitConfig.Enabled {
+		interval, err := time.ParseDuration(config.GitConfig.Interval)
+		if err != nil {
+			return err
+		}
+		s.git, err = wikie.OpenGitSync(esClient, db, config.GitConfig.Path, os.Stdout)
+		if err != nil {
+			return err
+		}
+		go func() {
+			for range time.Tick(interval) {
+				changed, err := s.git.Sync(context.Background())
+				if err != nil {
+					fmt.Println(err)
+				}
+				if changed {
+					s.publicExpired()
+				}
+			}
+		}()
 	}
 
 	if s.config.OAuth2Config != nil {
@@ -95,7 +160,7 @@ func main() {
 	g.GET("/", func(c *gin.Context) {
 		session := sessions.Default(c)
 		if session.Get("token") != nil {
-			if _, ok := s.sessions[session.Get("token").(string)]; ok {
+			if s.sessions.has(session.Get("token").(string)) {
 				c.Redirect(http.StatusTemporaryRedirect, "/w/home")
 				return
 			}
@@ -121,7 +186,7 @@ func main() {
 			c.Redirect(http.StatusTemporaryRedirect, "/")
 			return
 		}
-		if _, ok := s.sessions[token.(string)]; !ok {
+		if !s.sessions.has(token.(string)) {
 			c.Redirect(http.StatusTemporaryRedirect, "/")
 			return
 		}
@@ -185,7 +250,7 @@ func main() {
 			c.Redirect(http.StatusTemporaryRedirect, "/")
 			return
 		}
-		if _, ok := s.sessions[token.(string)]; !ok {
+		if !s.sessions.has(token.(string)) {
 			c.Redirect(http.StatusTemporaryRedirect, "/")
 			return
 		}
@@ -235,241 +300,31 @@ func main() {
 		return
 	})
 
-	g.GET("/storage", func(c *gin.Context) {
-		session := sessions.Default(c)
-		token := session.Get("token")
-		if token == nil {
-			c.Redirect(http.StatusTemporaryRedirect, "/")
-			return
-		}
-		if _, ok := s.sessions[token.(string)]; !ok {
-			c.Redirect(http.StatusTemporaryRedirect, "/")
-			return
-		}
-
-		u := session.Get("username").(string)
-		perm, err := s.hasPermissions(db, u)
-		if err != nil {
-			fmt.Println(err)
-			c.Status(http.StatusInternalServerError)
-			return
-		}
-
-		if !perm {
-			c.HTML(http.StatusUnauthorized, "waiting.html", nil)
-			c.AbortWithError(http.StatusUnauthorized, fmt.Errorf("user has no permissions to any pages"))
-			return
-		}
-
-		permissions, err := wikie.GetPermissions(db)
-		if err != nil {
-			fmt.Println(err)
-			c.Status(http.StatusInternalServerError)
-			return
-		}
-
-		username := session.Get("username").(string)
-		var files []string
-
-		if p, ok := permissions[username]; ok {
-			err := filepath.Walk("storage", func(path string, info os.FileInfo, err error) error {
-				if info.IsDir() {
-					return nil
-				}
-				for _, permission := range p {
-					if strings.Contains(path, permission.Path) && permission.Access >= wikie.PermissionRead {
-						files = append(files, path)
-					}
-				}
-				return nil
-			})
-			if err != nil {
-				fmt.Println(err)
-				c.Status(http.StatusInternalServerError)
-				return
-			}
-		}
-
-		c.HTML(http.StatusOK, "storage.html", files)
-	})
-	g.GET("/storage/*file", func(c *gin.Context) {
-		filePath := c.Param("file")
-
-		session := sessions.Default(c)
-		token := session.Get("token")
-		if token == nil {
-			c.Redirect(http.StatusTemporaryRedirect, "/")
-			return
-		}
-		if _, ok := s.sessions[token.(string)]; !ok {
-			c.Redirect(http.StatusTemporaryRedirect, "/")
-			return
-		}
-
-		if session.Get("token") == nil {
-			// Check to see if the referrer is public
-			u, err := url.Parse(c.Request.Referer())
-			if err != nil {
-				fmt.Println(err)
-				c.Status(http.StatusInternalServerError)
-				return
-			}
-			p := strings.Split(u.Path, "/")
-			if len(p) < 2 || p[1] != "public" {
-				c.HTML(http.StatusForbidden, "forbidden.html", nil)
-				return
-			}
-
-			// If the referrer is public, also check to see if the page is indeed public.
-			if page, err := wikie.GetPage(esClient, path.Dir(filePath)); err != nil {
-				fmt.Println(err)
-				c.Status(http.StatusInternalServerError)
-				return
-			} else if err == nil && !page.Public {
-				c.HTML(http.StatusForbidden, "forbidden.html", nil)
-				return
-			}
-		} else {
-			// Check for permission to the page.
-			if v := session.Get("username"); v != nil {
-				if len(filePath) > 0 && filePath[len(filePath)-1] == '/' {
-					c.Redirect(http.StatusTemporaryRedirect, path.Join("/w", filePath[:len(filePath)-1]))
-					return
-				}
-				if ok, err := wikie.HasPermission(db, v.(string), filePath, wikie.PermissionRead); err == nil && !ok {
-					c.HTML(http.StatusForbidden, "forbidden.html", nil)
-					return
-				} else if err != nil {
-					fmt.Println(err)
-					c.Status(http.StatusInternalServerError)
-					return
-				}
-			}
-		}
-
-		pathOnDisk := path.Join("storage", filePath)
-		if _, err := os.Stat(pathOnDisk); err != nil {
-			c.String(http.StatusForbidden, "forbidden")
-			return
-		}
-
-		f, err := os.OpenFile(pathOnDisk, os.O_RDONLY, 0777)
-		if err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
-			return
-		}
-
-		b, err := ioutil.ReadAll(f)
-		if err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
-			return
-		}
-
-		t, err := filetype.MatchReader(f)
-		if err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
-			return
-		}
-
-		c.Data(http.StatusOK, t.MIME.Value, b)
-	})
-	g.POST("/storage", func(c *gin.Context) {
-		session := sessions.Default(c)
-		token := session.Get("token")
-		if token == nil {
-			c.Redirect(http.StatusTemporaryRedirect, "/")
-			return
-		}
-		if _, ok := s.sessions[token.(string)]; !ok {
-			c.Redirect(http.StatusTemporaryRedirect, "/")
-			return
-		}
-
-		filePath := "/" + strings.Join(strings.Split(c.PostForm("file"), "/")[1:], "/")
-		if v, ok := c.GetPostForm("action"); v == "Delete" && ok {
-			if ok, err := wikie.HasPermission(db, session.Get("username").(string), filePath, wikie.PermissionWrite); err != nil {
-				fmt.Println(err)
-				c.Status(http.StatusInternalServerError)
-				return
-			} else if !ok {
-				fmt.Println(err)
-				c.String(http.StatusForbidden, "forbidden")
-				return
-			}
+	g.GET("/storage", s.storageView)
+	g.GET("/storage/*file", s.storageFile)
+	g.POST("/storage", s.storageAction)
+	g.POST("/storage/upload", s.storageUpload)
 
-			fileOnDisk := c.PostForm("file")
-			if _, err := os.Stat(fileOnDisk); err == nil || os.IsExist(err) {
-				err = os.Remove(fileOnDisk)
-				if err != nil {
-					fmt.Println(err)
-					c.Status(http.StatusInternalServerError)
-					return
-				}
-			}
+	g.GET("/profile", s.profileView)
+	g.POST("/profile", s.profile)
 
-		} else if v == "Upload" && ok {
-			file, err := c.FormFile("uploadfile")
-			if err != nil {
-				fmt.Println(err)
-				c.Status(http.StatusInternalServerError)
-				return
-			}
+	g.GET("/shares", s.sharesView)
+	g.POST("/shares", s.shareAction)
+	g.GET("/s/:token", s.shared)
+	g.POST("/s/:token", s.shared)
+	g.GET("/s/:token/*file", s.sharedFile)
 
-			if ok, err := wikie.HasPermission(db, session.Get("username").(string), c.PostForm("namespace"), wikie.PermissionWrite); err != nil {
-				fmt.Println(err)
-				c.Status(http.StatusInternalServerError)
-				return
-			} else if !ok {
-				fmt.Println(err)
-				c.String(http.StatusForbidden, "forbidden")
-				return
-			}
-
-			uploadPath := path.Join("storage", c.PostForm("namespace"))
-
-			err = os.MkdirAll(uploadPath, 0777)
-			if err != nil {
-				fmt.Println(err)
-				c.Status(http.StatusInternalServerError)
-				return
-			}
-
-			filename := filepath.Base(file.Filename)
-			err = c.SaveUploadedFile(file, path.Join(uploadPath, filename))
-			if err != nil {
-				fmt.Println(err)
-				c.Status(http.StatusInternalServerError)
-				return
-			}
-		}
+	g.GET("/backup", s.backupDownload)
+	g.GET("/sessions", s.sessionsView)
+	g.POST("/sessions", s.sessionsAction)
 
-		c.Redirect(http.StatusFound, c.Request.Referer())
-	})
+	g.GET("/export/*page", s.exportBundle)
 
 	g.GET("/search", s.search)
+	g.GET("/search/suggest", s.suggest)
 
-	g.GET("/public/*page", func(c *gin.Context) {
-		pagePath := c.Param("page")
-		if len(pagePath) > 0 && pagePath[len(pagePath)-1] == '/' {
-			c.Redirect(http.StatusTemporaryRedirect, path.Join("/public", pagePath[:len(pagePath)-1]))
-			return
-		}
-
-		page, err := wikie.GetPage(esClient, pagePath)
-		if err != nil {
-			fmt.Println(err)
-			c.HTML(http.StatusForbidden, "forbidden.html", nil)
-			return
-		}
-
-		if page.Public {
-			c.HTML(http.StatusOK, "public.html", page)
-			return
-		}
-
-		c.HTML(http.StatusForbidden, "forbidden.html", nil)
-		return
-	})
+	g.GET("/public", s.publicView)
+	g.GET("/public/*page", s.publicView)
 
 	wiki := g.Group("/w")
 
@@ -481,7 +336,7 @@ func main() {
 			c.Redirect(http.StatusTemporaryRedirect, "/")
 			return
 		}
-		if _, ok := s.sessions[token.(string)]; !ok {
+		if !s.sessions.has(token.(string)) {
 			c.Redirect(http.StatusTemporaryRedirect, "/")
 			return
 		}
@@ -500,7 +355,7 @@ func main() {
 			return
 		}
 
-		if _, ok := s.sessions[token.(string)]; ok {
+		if s.sessions.has(token.(string)) {
 			c.Next()
 			return
 		}
@@ -553,37 +408,13 @@ func main() {
 					return
 				}
 
-				permissions, err := wikie.GetPermissions(db)
+				files, err := s.namespaceFiles(session.Get("username").(string), pagePath)
 				if err != nil {
 					fmt.Println(err)
 					c.Status(http.StatusInternalServerError)
 					return
 				}
 
-				username := session.Get("username").(string)
-				var files []string
-				if p, ok := permissions[username]; ok {
-					err := filepath.Walk(path.Join("storage", pagePath), func(path string, info os.FileInfo, err error) error {
-						if err != nil {
-							return nil
-						}
-						if info.IsDir() {
-							return nil
-						}
-						for _, permission := range p {
-							if strings.Contains(path, permission.Path) && permission.Access >= wikie.PermissionRead {
-								files = append(files, path)
-							}
-						}
-						return nil
-					})
-					if err != nil {
-						fmt.Println(err)
-						c.Status(http.StatusInternalServerError)
-						return
-					}
-				}
-
 				page.Files = files
 
 				c.HTML(http.StatusOK, "notfound.html", wikie.Page{Path: pagePath, Files: files})
@@ -607,40 +438,32 @@ func main() {
 				return
 			}
 
-			permissions, err := wikie.GetPermissions(db)
+			files, err := s.namespaceFiles(session.Get("username").(string), pagePath)
 			if err != nil {
 				fmt.Println(err)
 				c.Status(http.StatusInternalServerError)
 				return
 			}
 
-			username := session.Get("username").(string)
-			var files []string
-			if p, ok := permissions[username]; ok {
-				err := filepath.Walk(path.Join("storage", pagePath), func(path string, info os.FileInfo, err error) error {
-					if err != nil || info.IsDir() {
-						return nil
-					}
-					for _, permission := range p {
-						if strings.Contains(path, permission.Path) && permission.Access >= wikie.PermissionRead {
-							files = append(files, path)
-						}
-					}
-					return nil
-				})
-				if err != nil {
-					fmt.Println(err)
-					c.Status(http.StatusInternalServerError)
-					return
-				}
-			}
-
 			page.Files = files
 
 			c.HTML(http.StatusOK, "edit.html", page)
 			return
 		}
 
+		if _, ok := c.GetQuery("history"); ok {
+			s.pageHistory(c, page)
+			return
+		}
+
+		related, err := s.relatedPages(page, session.Get("username").(string))
+		if err != nil {
+			// Related pages are not essential to reading the page.
+			fmt.Println(err)
+		}
+		page.Related = related
+		page.Location = s.location(session)
+
 		c.HTML(http.StatusOK, "page.html", page)
 		return
 	})
@@ -652,6 +475,13 @@ func main() {
 			return
 		}
 
+		// Pages are also written to files named after their paths, so only
+		// clean paths are saved. A trailing slash is redirected below.
+		if err := wikie.CheckPagePath(strings.TrimSuffix(c.Param("page"), "/")); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
 		// Check for permission to the page.
 		if v := session.Get("username"); v != nil {
 			pagePath := c.Param("page")
@@ -673,14 +503,14 @@ func main() {
 		if len(pagePath) > 0 && pagePath[len(pagePath)-1] == '/' {
 			c.Redirect(http.StatusTemporaryRedirect, path.Join("/w", pagePath[:len(pagePath)-1]))
 		}
-		s, err := c.GetRawData()
+		b, err := c.GetRawData()
 		if err != nil {
 			fmt.Println(err)
 			c.Status(http.StatusInternalServerError)
 			return
 		}
 		var p wikie.Page
-		err = json.Unmarshal(s, &p)
+		err = json.Unmarshal(b, &p)
 		if err != nil {
 			fmt.Println(err)
 			c.Status(http.StatusInternalServerError)
@@ -688,14 +518,33 @@ func main() {
 		}
 
 		p.Path = pagePath
-		p.LastUpdated = time.Now().Format(time.RFC822)
+		p.LastUpdated = time.Now()
 		p.EditedBy = session.Get("username").(string)
-		err = wikie.NewPage(esClient, pagePath, p)
+		// The page may have been created since the editor was opened, such as
+		// by a push to git, so an existing page is never replaced.
+		err = wikie.CreatePage(esClient, pagePath, p)
+		if err == wikie.ErrPageChanged {
+			c.Status(http.StatusConflict)
+			return
+		} else if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		err = wikie.AddPageRevisions(db, pagePath, wikie.PageRevision{Body: p.Body, EditedBy: p.EditedBy, Updated: p.LastUpdated})
 		if err != nil {
 			fmt.Println(err)
 			c.Status(http.StatusInternalServerError)
 			return
 		}
+		s.publicSaved(pagePath)
+		if s.git != nil {
+			// The page is saved; git catches up with the next save.
+			err = s.git.SavePage(context.Background(), pagePath)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
 		c.Status(http.StatusOK)
 		return
 	})
@@ -707,6 +556,13 @@ func main() {
 			return
 		}
 
+		// Pages are also written to files named after their paths, so only
+		// clean paths are saved. A trailing slash is redirected below.
+		if err := wikie.CheckPagePath(strings.TrimSuffix(c.Param("page"), "/")); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
 		pagePath := c.Param("page")
 		if len(pagePath) > 0 && pagePath[len(pagePath)-1] == '/' {
 			c.Redirect(http.StatusTemporaryRedirect, path.Join("/w", pagePath[:len(pagePath)-1]))
@@ -729,7 +585,7 @@ func main() {
 			}
 		}
 
-		s, err := c.GetRawData()
+		b, err := c.GetRawData()
 		if err != nil {
 			fmt.Println(err)
 			c.Status(http.StatusInternalServerError)
@@ -737,22 +593,55 @@ func main() {
 		}
 
 		var p wikie.Page
-		err = json.Unmarshal(s, &p)
+		err = json.Unmarshal(b, &p)
 		if err != nil {
 			fmt.Println(err)
 			c.Status(http.StatusInternalServerError)
 			return
 		}
 
-		p.LastUpdated = time.Now().Format(time.RFC822)
+		p.LastUpdated = time.Now()
 		p.EditedBy = session.Get("username").(string)
 
-		err = wikie.UpdatePage(esClient, pagePath, p)
+		// The page may have changed since the editor was opened, such as by a
+		// push to git. The save only goes ahead if the page is still the one
+		// which was checked.
+		var current wikie.Page
+		ifMatch := c.GetHeader("If-Match")
+		if ifMatch != "" {
+			current, err = wikie.GetPage(esClient, pagePath)
+		}
+		if ifMatch != "" && err == nil {
+			if strconv.FormatInt(current.Version, 10) != ifMatch {
+				c.Status(http.StatusConflict)
+				return
+			}
+			err = wikie.UpdatePageIf(esClient, pagePath, p, current)
+		} else {
+			err = wikie.UpdatePage(esClient, pagePath, p)
+		}
+		if err == wikie.ErrPageChanged {
+			c.Status(http.StatusConflict)
+			return
+		} else if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		err = wikie.AddPageRevisions(db, pagePath, wikie.PageRevision{Body: p.Body, EditedBy: p.EditedBy, Updated: p.LastUpdated})
 		if err != nil {
 			fmt.Println(err)
 			c.Status(http.StatusInternalServerError)
 			return
 		}
+		s.publicSaved(pagePath)
+		if s.git != nil {
+			// The page is saved; git catches up with the next save.
+			err = s.git.SavePage(context.Background(), pagePath)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
 		c.Status(http.StatusOK)
 		return
 	})
@@ -769,5 +658,5 @@ author: h.scells@uq.net.au
 version: 14.Feb.2019
 `)
 
-	log.Panic(http.ListenAndServe("0.0.0.0:"+config.Port, g))
+	return http.ListenAndServe("0.0.0.0:"+config.Port, g)
 }
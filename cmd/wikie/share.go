@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/ielab/wikie"
+	"html/template"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxShareDays is the longest a share link can last.
+const maxShareDays = 365
+
+const (
+	// sharePasswordWindow is how long failed attempts at the password of a
+	// share are remembered.
+	sharePasswordWindow = 15 * time.Minute
+	// maxShareFailures is how many wrong passwords a share accepts in the
+	// window before it refuses any more, from anyone.
+	maxShareFailures = 10
+	// maxAddressFailures is how many wrong passwords, to any share, one
+	// address may give in the window.
+	maxAddressFailures = 20
+)
+
+// failureLimiter counts recent failures, such as wrong passwords, by key.
+type failureLimiter struct {
+	sync.Mutex
+	limit    int
+	window   time.Duration
+	failures map[string][]time.Time
+}
+
+func newFailureLimiter(limit int, window time.Duration) *failureLimiter {
+	return &failureLimiter{limit: limit, window: window, failures: make(map[string][]time.Time)}
+}
+
+// recent returns the failures of key within the window. The limiter must be locked.
+func (l *failureLimiter) recent(key string, now time.Time) []time.Time {
+	failures := l.failures[key]
+	for len(failures) > 0 && now.Sub(failures[0]) > l.window {
+		failures = failures[1:]
+	}
+	if len(failures) == 0 {
+		delete(l.failures, key)
+		return nil
+	}
+	l.failures[key] = failures
+	return failures
+}
+
+// allowed reports whether key has had fewer failures than the limit in the window.
+func (l *failureLimiter) allowed(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.recent(key, time.Now())) < l.limit
+}
+
+// fail records a failure of key.
+func (l *failureLimiter) fail(key string) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.failures[key] = append(l.recent(key, now), now)
+	// Forget keys whose failures have all expired, so the map cannot grow
+	// without bound.
+	if len(l.failures) > 10000 {
+		for k := range l.failures {
+			l.recent(k, now)
+		}
+	}
+}
+
+type shareLink struct {
+	wikie.Share
+	URL string
+}
+
+type sharesPage struct {
+	Shares []shareLink
+	// Created is the share just made, if any, so its link can be shown.
+	Created string
+	Now     time.Time
+	Error   string
+}
+
+type sharedPage struct {
+	Share  wikie.Share
+	Token  string
+	Page   wikie.Page
+	Body   template.HTML
+	Locked bool
+	Error  string
+}
+
+func (s server) isAdmin(user string) bool {
+	for _, admin := range s.config.Admins {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+func (s server) sharesView(c *gin.Context) {
+	session := sessions.Default(c)
+	token := session.Get("token")
+	if token == nil {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	if !s.sessions.has(token.(string)) {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+
+	username := session.Get("username").(string)
+	page, err := s.sharesPage(username)
+	if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	page.Created = c.Query("created")
+	c.HTML(http.StatusOK, "shares.html", page)
+}
+
+// sharesPage lists the shares user has made, or every share for admins.
+func (s server) sharesPage(user string) (sharesPage, error) {
+	owner := user
+	if s.isAdmin(user) {
+		owner = ""
+	}
+	shares, err := wikie.GetShares(s.permissionDB, owner)
+	if err != nil {
+		return sharesPage{}, err
+	}
+	page := sharesPage{Now: time.Now()}
+	for _, share := range shares {
+		page.Shares = append(page.Shares, shareLink{share, "/s/" + share.Token(s.config.ShareSecret)})
+	}
+	return page, nil
+}
+
+// shareAction creates a share link, or revokes one.
+func (s server) shareAction(c *gin.Context) {
+	session := sessions.Default(c)
+	token := session.Get("token")
+	if token == nil {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	if !s.sessions.has(token.(string)) {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	username := session.Get("username").(string)
+
+	if c.PostForm("action") == "Revoke" {
+		shares, err := wikie.GetShares(s.permissionDB, "")
+		if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		for _, share := range shares {
+			if share.ID != c.PostForm("id") {
+				continue
+			}
+			if share.CreatedBy != username && !s.isAdmin(username) {
+				c.HTML(http.StatusForbidden, "forbidden.html", nil)
+				return
+			}
+			err = wikie.RevokeShare(s.permissionDB, share.ID)
+			if err != nil {
+				fmt.Println(err)
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+		}
+		c.Redirect(http.StatusFound, "/shares")
+		return
+	}
+
+	kind := c.PostForm("kind")
+	var sharePath string
+	switch kind {
+	case wikie.SharePage:
+		sharePath = path.Clean("/" + c.PostForm("path"))
+	case wikie.ShareFile:
+		var err error
+		sharePath, err = wikie.ResolveStoragePath(c.PostForm("path"))
+		if err != nil || sharePath == "/" {
+			c.HTML(http.StatusForbidden, "forbidden.html", nil)
+			return
+		}
+	default:
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	// Sharing lets anyone read the page or file, so it takes more than being
+	// able to read it oneself.
+	if ok, err := wikie.HasPermission(s.permissionDB, username, sharePath, wikie.PermissionWrite); err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	} else if !ok {
+		c.HTML(http.StatusForbidden, "forbidden.html", nil)
+		return
+	}
+
+	days, err := strconv.Atoi(c.DefaultPostForm("days", "7"))
+	if err != nil || days < 1 || days > maxShareDays {
+		page, err := s.sharesPage(username)
+		if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		page.Error = fmt.Sprintf("share links can last between 1 and %d days", maxShareDays)
+		c.HTML(http.StatusBadRequest, "shares.html", page)
+		return
+	}
+
+	share, err := wikie.NewShare(s.permissionDB, kind, sharePath, username, time.Duration(days)*24*time.Hour, c.PostForm("password"))
+	if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Redirect(http.StatusFound, "/shares?created="+share.ID)
+}
+
+// shareKey is the session key recording that the password of a share was given.
+func shareKey(share wikie.Share) string {
+	return "share." + share.ID
+}
+
+// shared shows the page or file behind a share link to anyone who has it.
+func (s server) shared(c *gin.Context) {
+	share, ok := s.verifyShare(c)
+	if !ok {
+		return
+	}
+
+	if c.Request.Method == http.MethodPost {
+		// Passwords are slow to check and may be guessed, so each share,
+		// and each address, only gets so many wrong ones.
+		address := c.ClientIP()
+		if !s.shareFailures.allowed(share.ID) || !s.addressFailures.allowed(address) {
+			c.HTML(http.StatusTooManyRequests, "shared.html", sharedPage{Share: share, Token: c.Param("token"), Locked: true, Error: "too many wrong passwords, try again later"})
+			return
+		}
+		err := share.CheckPassword(c.PostForm("password"))
+		if err != nil {
+			s.shareFailures.fail(share.ID)
+			s.addressFailures.fail(address)
+			c.HTML(http.StatusForbidden, "shared.html", sharedPage{Share: share, Token: c.Param("token"), Locked: true, Error: err.Error()})
+			return
+		}
+		session := sessions.Default(c)
+		session.Set(shareKey(share), true)
+		err = session.Save()
+		if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Redirect(http.StatusFound, c.Request.URL.Path)
+		return
+	}
+
+	if !s.unlocked(c, share) {
+		c.HTML(http.StatusOK, "shared.html", sharedPage{Share: share, Token: c.Param("token"), Locked: true})
+		return
+	}
+
+	if share.Kind == wikie.ShareFile {
+		s.serveStoredFile(c, share.Path)
+		return
+	}
+
+	page, err := wikie.GetPage(s.esClient, share.Path)
+	if err != nil {
+		fmt.Println(err)
+		c.HTML(http.StatusNotFound, "forbidden.html", nil)
+		return
+	}
+	page.Location = s.location(sessions.Default(c))
+
+	// Files uploaded to the page are reached through the share link too.
+	base := "/s/" + c.Param("token") + "/"
+	body := strings.Replace(string(page.Render()), `"/storage`+strings.TrimSuffix(share.Path, "/")+"/", `"`+base, -1)
+	body = strings.Replace(body, ` /storage`+strings.TrimSuffix(share.Path, "/")+"/", ` `+base, -1)
+	c.HTML(http.StatusOK, "shared.html", sharedPage{Share: share, Token: c.Param("token"), Page: page, Body: template.HTML(body)})
+}
+
+// sharedFile serves a file uploaded to a shared page.
+func (s server) sharedFile(c *gin.Context) {
+	share, ok := s.verifyShare(c)
+	if !ok {
+		return
+	}
+	if !s.unlocked(c, share) {
+		c.Redirect(http.StatusFound, "/s/"+c.Param("token"))
+		return
+	}
+
+	filePath, err := wikie.ResolveStoragePath(strings.TrimSuffix(share.Path, "/") + "/" + strings.TrimPrefix(c.Param("file"), "/"))
+	if err != nil || !share.Allows(filePath) {
+		c.HTML(http.StatusForbidden, "forbidden.html", nil)
+		return
+	}
+	s.serveStoredFile(c, filePath)
+}
+
+func (s server) verifyShare(c *gin.Context) (wikie.Share, bool) {
+	share, err := wikie.VerifyShare(s.permissionDB, s.config.ShareSecret, c.Param("token"))
+	if err == wikie.ErrInvalidShare {
+		c.HTML(http.StatusNotFound, "forbidden.html", nil)
+		return share, false
+	} else if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return share, false
+	}
+	// Shared pages are not for search engines.
+	c.Header("X-Robots-Tag", "noindex")
+	c.Header("Referrer-Policy", "no-referrer")
+	return share, true
+}
+
+func (s server) unlocked(c *gin.Context, share wikie.Share) bool {
+	if !share.HasPassword() {
+		return true
+	}
+	v, ok := sessions.Default(c).Get(shareKey(share)).(bool)
+	return ok && v
+}
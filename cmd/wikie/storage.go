@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/go-errors/errors"
+	"github.com/ielab/wikie"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFormValue is the largest non-file field accepted in an upload form.
+const maxFormValue = 4096
+
+// maxFormOverhead is how much of an upload request may be taken by the
+// fields and part headers of the form rather than the files.
+const maxFormOverhead = 64 << 10
+
+// markdownText escapes what would end the text of a markdown link early.
+var markdownText = strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`)
+
+// namespaceFiles returns the history of each file stored under namespace that
+// user can read.
+func (s server) namespaceFiles(user, namespace string) ([]wikie.FileHistory, error) {
+	resolved, err := wikie.ResolveStoragePath(namespace)
+	if err != nil {
+		return nil, err
+	}
+	prefix := wikie.StorageKey(resolved)
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	blobs, err := s.blobs.List(context.Background(), prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []wikie.FileHistory
+	for _, blob := range blobs {
+		filePath := "/" + blob.Key
+		ok, err := wikie.HasPermission(s.permissionDB, user, filePath, wikie.PermissionRead)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		history, err := wikie.GetFileHistory(s.permissionDB, filePath)
+		if err != nil {
+			return nil, err
+		}
+		// Files uploaded before histories were kept only have what the store knows.
+		if len(history.Versions) == 0 {
+			history.Versions = []wikie.FileVersion{{Version: 1, Size: blob.Size, Uploaded: blob.ModTime}}
+		}
+		files = append(files, history)
+	}
+	return files, nil
+}
+
+type namespaceQuota struct {
+	Namespace string
+	Used      int64
+	Quota     int64
+}
+
+type storagePage struct {
+	Files      []wikie.FileHistory
+	Username   string
+	Used       int64
+	Total      int64
+	Namespaces []wikie.UsageEntry
+	Quotas     []namespaceQuota
+	// Users is only reported to admins.
+	Users  []wikie.UsageEntry
+	Policy wikie.StoragePolicy
+}
+
+func (s server) storageView(c *gin.Context) {
+	session := sessions.Default(c)
+	token := session.Get("token")
+	if token == nil {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	if !s.sessions.has(token.(string)) {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+
+	u := session.Get("username").(string)
+	perm, err := s.hasPermissions(s.permissionDB, u)
+	if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if !perm {
+		c.HTML(http.StatusUnauthorized, "waiting.html", nil)
+		c.AbortWithError(http.StatusUnauthorized, fmt.Errorf("user has no permissions to any pages"))
+		return
+	}
+
+	files, err := s.namespaceFiles(u, "/")
+	if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	usage, err := wikie.GetStorageUsage(c.Request.Context(), s.permissionDB, s.blobs)
+	if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	// Only report on namespaces the user can see into.
+	var namespaces []wikie.UsageEntry
+	for _, entry := range usage.Namespaces() {
+		if ok, err := wikie.HasPermission(s.permissionDB, u, entry.Name, wikie.PermissionRead); err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		} else if ok {
+			namespaces = append(namespaces, entry)
+		}
+	}
+	var quotas []namespaceQuota
+	for namespace, quota := range s.policy.NamespaceQuotas {
+		quotas = append(quotas, namespaceQuota{Namespace: namespace, Used: usage.Under(namespace), Quota: quota})
+	}
+	sort.Slice(quotas, func(i, j int) bool {
+		return quotas[i].Namespace < quotas[j].Namespace
+	})
+
+	var users []wikie.UsageEntry
+	if s.isAdmin(u) {
+		users = usage.Users()
+	}
+
+	c.HTML(http.StatusOK, "storage.html", storagePage{
+		Files:      files,
+		Username:   u,
+		Used:       usage.ByUser(u),
+		Total:      usage.Total(),
+		Namespaces: namespaces,
+		Quotas:     quotas,
+		Users:      users,
+		Policy:     s.policy,
+	})
+}
+
+func (s server) storageFile(c *gin.Context) {
+	if filePath := c.Param("file"); len(filePath) > 1 && filePath[len(filePath)-1] == '/' {
+		c.Redirect(http.StatusTemporaryRedirect, path.Join("/w", filePath[:len(filePath)-1]))
+		return
+	}
+	filePath, err := wikie.ResolveStoragePath(c.Param("file"))
+	if err != nil {
+		c.HTML(http.StatusForbidden, "forbidden.html", nil)
+		return
+	}
+
+	session := sessions.Default(c)
+	// Without an account, only files which have been published can be read.
+	// Others are shared through share links.
+	if token := session.Get("token"); token == nil || !s.sessions.has(token.(string)) {
+		history, err := wikie.GetFileHistory(s.permissionDB, filePath)
+		if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		if !history.Public {
+			c.HTML(http.StatusForbidden, "forbidden.html", nil)
+			return
+		}
+	} else if ok, err := wikie.HasPermission(s.permissionDB, session.Get("username").(string), filePath, wikie.PermissionRead); err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	} else if !ok {
+		c.HTML(http.StatusForbidden, "forbidden.html", nil)
+		return
+	}
+
+	s.serveStoredFile(c, filePath)
+}
+
+// serveStoredFile writes the file at filePath, or the variant of it asked for
+// if it is an image. Callers check that the file may be read.
+func (s server) serveStoredFile(c *gin.Context, filePath string) {
+	f, info, err := s.blobs.Open(c.Request.Context(), wikie.StorageKey(filePath))
+	if err == wikie.ErrBlobNotFound {
+		c.String(http.StatusForbidden, "forbidden")
+		return
+	} else if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer f.Close()
+
+	contentType, err := wikie.SniffContentType(filePath, f)
+	if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	history, err := wikie.GetFileHistory(s.permissionDB, filePath)
+	if err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	hash := history.Current().Hash
+	etag := hash
+	if len(etag) == 0 {
+		etag = fmt.Sprintf("%x-%x", info.ModTime.UnixNano(), info.Size)
+	}
+
+	// Images can be asked for at a smaller size (?w=800) or without their
+	// metadata (?strip).
+	width, _ := strconv.Atoi(c.Query("w"))
+	_, strip := c.GetQuery("strip")
+	if (width > 0 || strip) && wikie.Resizable(contentType) {
+		if width > 0 {
+			width = wikie.ImageWidth(width)
+		}
+		variant, variantInfo, err := wikie.ImageVariant(c.Request.Context(), s.blobs, wikie.StorageKey(filePath), hash, contentType, width, strip)
+		if err == nil {
+			defer variant.Close()
+			etag = fmt.Sprintf("%s-%d", etag, width)
+			if strip {
+				etag += "-strip"
+			}
+			serveFile(c.Writer, c.Request, path.Base(filePath), contentType, etag, variantInfo.ModTime, variant)
+			return
+		} else if err != wikie.ErrNotResizable {
+			// The original is still served when a variant cannot be made.
+			fmt.Println(err)
+		}
+	}
+
+	serveFile(c.Writer, c.Request, path.Base(filePath), contentType, etag, info.ModTime, f)
+}
+
+// userFilePolicy is the Content-Security-Policy of files users upload, which
+// stops anything that does get rendered from running script or loading
+// anything from elsewhere.
+const userFilePolicy = "default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'; frame-ancestors 'self'"
+
+// serveFile writes a user's file with headers that keep the browser from
+// treating it as part of wikie. Only types which are safe to display inline
+// are; everything else is downloaded.
+func serveFile(w http.ResponseWriter, r *http.Request, name, contentType, etag string, modTime time.Time, content io.ReadSeeker) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", userFilePolicy)
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	disposition := "attachment"
+	if wikie.Inline(contentType) {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+
+	// ServeContent streams the file and answers Range and conditional
+	// requests from the ETag and modification time.
+	http.ServeContent(w, r, name, modTime, content)
+}
+
+func (s server) storageAction(c *gin.Context) {
+	session := sessions.Default(c)
+	token := session.Get("token")
+	if token == nil {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	if !s.sessions.has(token.(string)) {
+		c.Redirect(http.StatusTemporaryRedirect, "/")
+		return
+	}
+	username := session.Get("username").(string)
+
+	// Uploads are multipart and are streamed straight into storage rather
+	// than being buffered by the form parser.
+	if mr, err := c.Request.MultipartReader(); err == nil {
+		status, err := s.upload(c.Request, mr, username)
+		if status == http.StatusRequestEntityTooLarge {
+			// What is left of the upload is not read.
+			c.Header("Connection", "close")
+		}
+		if err != nil {
+			fmt.Println(err)
+			switch status {
+			case http.StatusForbidden:
+				c.String(http.StatusForbidden, "forbidden")
+				return
+			case http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType:
+				c.String(status, err.Error())
+				return
+			}
+			c.Status(status)
+			return
+		}
+		c.Redirect(http.StatusFound, c.Request.Referer())
+		return
+	}
+
+	filePath, err := wikie.ResolveStoragePath(c.PostForm("file"))
+	if err != nil || filePath == "/" {
+		fmt.Println(err)
+		c.String(http.StatusForbidden, "forbidden")
+		return
+	}
+	if ok, err := wikie.HasPermission(s.permissionDB, username, filePath, wikie.PermissionWrite); err != nil {
+		fmt.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	} else if !ok {
+		fmt.Println(err)
+		c.String(http.StatusForbidden, "forbidden")
+		return
+	}
+
+	if v, ok := c.GetPostForm("action"); v == "Delete" && ok {
+		err = wikie.DeleteFile(c.Request.Context(), s.permissionDB, s.blobs, filePath)
+		if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+
+		err = wikie.DeleteAttachment(s.esClient, filePath)
+		if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+	} else if (v == "Publish" || v == "Unpublish") && ok {
+		err = wikie.PublishFile(c.Request.Context(), s.permissionDB, s.blobs, filePath, v == "Publish")
+		if err == wikie.ErrBlobNotFound {
+			c.Status(http.StatusNotFound)
+			return
+		} else if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+	} else if v == "Restore" && ok {
+		version, err := strconv.Atoi(c.PostForm("version"))
+		if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusBadRequest)
+			return
+		}
+
+		// A restore is a new version, so it counts against quotas as an upload does.
+		history, err := wikie.GetFileHistory(s.permissionDB, filePath)
+		if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		usage, err := wikie.GetStorageUsage(c.Request.Context(), s.permissionDB, s.blobs)
+		if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		allowance, limitErr := s.policy.Allowance(usage, username, filePath)
+		for _, v := range history.Versions {
+			if v.Version == version && allowance >= 0 && v.Size > allowance {
+				c.String(http.StatusRequestEntityTooLarge, limitErr.Error())
+				return
+			}
+		}
+
+		_, err = wikie.RestoreFile(c.Request.Context(), s.permissionDB, s.blobs, filePath, version, username, s.policy.Reserve(username, filePath))
+		if errors.Is(err, wikie.ErrUploadTooLarge) || errors.Is(err, wikie.ErrQuotaExceeded) {
+			c.String(http.StatusRequestEntityTooLarge, err.Error())
+			return
+		} else if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+
+		err = s.indexAttachment(filePath, username)
+		if err != nil {
+			fmt.Println(err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	c.Redirect(http.StatusFound, c.Request.Referer())
+}
+
+// checkContentLength refuses an upload whose request is already too large for
+// the storage policy, before any of it is read.
+func (s server) checkContentLength(r *http.Request, usage wikie.StorageUsage, user string, single bool) error {
+	allowance, limitErr := s.policy.RequestAllowance(usage, user, single)
+	if allowance >= 0 && r.ContentLength > allowance+maxFormOverhead {
+		return limitErr
+	}
+	return nil
+}
+
+// upload reads an upload form part by part, writing each file to storage as
+// it arrives. The namespace field must come before the files in the form. It
+// returns the status to respond with when the upload fails.
+func (s server) upload(r *http.Request, mr *multipart.Reader, user string) (int, error) {
+	usage, err := wikie.GetStorageUsage(r.Context(), s.permissionDB, s.blobs)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = s.checkContentLength(r, usage, user, false)
+	if err != nil {
+		return http.StatusRequestEntityTooLarge, err
+	}
+
+	var namespace string
+	var uploaded []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		switch part.FormName() {
+		case "namespace":
+			b, err := ioutil.ReadAll(io.LimitReader(part, maxFormValue))
+			if err != nil {
+				return http.StatusBadRequest, err
+			}
+			namespace, err = wikie.ResolveStoragePath(string(b))
+			if err != nil {
+				return http.StatusForbidden, err
+			}
+		case "uploadfile":
+			if len(part.FileName()) == 0 {
+				continue
+			}
+			if len(namespace) == 0 {
+				return http.StatusBadRequest, fmt.Errorf("no namespace given before %s", part.FileName())
+			}
+			// The file name is resolved as part of the whole path, so a name
+			// which is itself a path cannot climb out of the namespace.
+			filePath, err := wikie.ResolveStoragePath(strings.TrimSuffix(namespace, "/") + "/" + part.FileName())
+			if err != nil || path.Dir(filePath) != namespace {
+				return http.StatusForbidden, fmt.Errorf("invalid file name %q", part.FileName())
+			}
+			_, status, err := s.storeUpload(filePath, part, user)
+			if err != nil {
+				return status, err
+			}
+			uploaded = append(uploaded, filePath)
+		}
+		part.Close()
+	}
+
+	for _, filePath := range uploaded {
+		err := s.indexAttachment(filePath, user)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// storeUpload checks that user may upload the file in r to filePath, and that
+// it is within the storage policy, before storing it. It returns the type of
+// the file, or the status to respond with when the upload fails.
+func (s server) storeUpload(filePath string, r io.Reader, user string) (string, int, error) {
+	if ok, err := wikie.HasPermission(s.permissionDB, user, filePath, wikie.PermissionWrite); err != nil {
+		return "", http.StatusInternalServerError, err
+	} else if !ok {
+		return "", http.StatusForbidden, fmt.Errorf("%s cannot upload to %s", user, filePath)
+	}
+
+	// The type is checked from the start of the file, and the size as the
+	// file is read, so an upload is refused as soon as it is too large. The
+	// quotas are checked again as the file is recorded, as other uploads may
+	// have been recorded since usage was read.
+	br := bufio.NewReaderSize(r, 512)
+	head, _ := br.Peek(512)
+	contentType := wikie.DetectContentType(filePath, head)
+	err := s.policy.CheckType(contentType)
+	if err != nil {
+		return "", http.StatusUnsupportedMediaType, err
+	}
+	usage, err := wikie.GetStorageUsage(context.Background(), s.permissionDB, s.blobs)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	allowance, limitErr := s.policy.Allowance(usage, user, filePath)
+
+	_, err = wikie.StoreFile(context.Background(), s.permissionDB, s.blobs, filePath, wikie.LimitReader(br, allowance, limitErr), contentType, user, s.policy.Reserve(user, filePath))
+	if errors.Is(err, wikie.ErrUploadTooLarge) || errors.Is(err, wikie.ErrQuotaExceeded) {
+		return "", http.StatusRequestEntityTooLarge, err
+	} else if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	return contentType, http.StatusOK, nil
+}
+
+type uploadResponse struct {
+	Path     string `json:"path,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Markdown string `json:"markdown,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// storageUpload stores a single file sent by the editor, given a new name if
+// one already exists with its name, and responds with how to link to it. The
+// form has a namespace field followed by a file field.
+func (s server) storageUpload(c *gin.Context) {
+	session := sessions.Default(c)
+	token := session.Get("token")
+	if token == nil {
+		c.JSON(http.StatusUnauthorized, uploadResponse{Error: "not logged in"})
+		return
+	}
+	if !s.sessions.has(token.(string)) {
+		c.JSON(http.StatusUnauthorized, uploadResponse{Error: "not logged in"})
+		return
+	}
+	username := session.Get("username").(string)
+
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, uploadResponse{Error: err.Error()})
+		return
+	}
+	usage, err := wikie.GetStorageUsage(c.Request.Context(), s.permissionDB, s.blobs)
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusInternalServerError, uploadResponse{Error: "could not store the file"})
+		return
+	}
+	err = s.checkContentLength(c.Request, usage, username, true)
+	if err != nil {
+		c.Header("Connection", "close")
+		c.JSON(http.StatusRequestEntityTooLarge, uploadResponse{Error: err.Error()})
+		return
+	}
+	var namespace string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			c.JSON(http.StatusBadRequest, uploadResponse{Error: "no file was uploaded"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, uploadResponse{Error: err.Error()})
+			return
+		}
+
+		switch part.FormName() {
+		case "namespace":
+			b, err := ioutil.ReadAll(io.LimitReader(part, maxFormValue))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, uploadResponse{Error: err.Error()})
+				return
+			}
+			namespace, err = wikie.ResolveStoragePath(string(b))
+			if err != nil {
+				c.JSON(http.StatusForbidden, uploadResponse{Error: "forbidden"})
+				return
+			}
+		case "file":
+			if len(namespace) == 0 {
+				c.JSON(http.StatusBadRequest, uploadResponse{Error: "no namespace given"})
+				return
+			}
+			filePath, err := wikie.UniqueFilePath(c.Request.Context(), s.blobs, namespace, part.FileName())
+			if err != nil {
+				fmt.Println(err)
+				c.JSON(http.StatusInternalServerError, uploadResponse{Error: "could not name the file"})
+				return
+			}
+			contentType, status, err := s.storeUpload(filePath, part, username)
+			if status == http.StatusRequestEntityTooLarge {
+				c.Header("Connection", "close")
+			}
+			if status == http.StatusForbidden {
+				fmt.Println(err)
+				c.JSON(status, uploadResponse{Error: "forbidden"})
+				return
+			} else if status == http.StatusInternalServerError {
+				fmt.Println(err)
+				c.JSON(status, uploadResponse{Error: "could not store the file"})
+				return
+			} else if err != nil {
+				c.JSON(status, uploadResponse{Error: err.Error()})
+				return
+			}
+
+			err = s.indexAttachment(filePath, username)
+			if err != nil {
+				fmt.Println(err)
+			}
+
+			u := (&url.URL{Path: "/storage" + filePath}).String()
+			markdown := "[" + markdownText.Replace(path.Base(filePath)) + "](" + u + ")"
+			if strings.HasPrefix(contentType, "image/") {
+				markdown = "!" + markdown
+			}
+			c.JSON(http.StatusOK, uploadResponse{Path: filePath, URL: u, Markdown: markdown})
+			return
+		}
+		part.Close()
+	}
+}
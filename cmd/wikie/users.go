@@ -0,0 +1,188 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ielab/wikie"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type userEntry struct {
+	User     string `json:"user"`
+	Admin    bool   `json:"admin"`
+	Paths    int    `json:"paths"`
+	Sessions int    `json:"sessions"`
+}
+
+// users lists the users who have permissions or have logged in, and removes them.
+func users(config wikie.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: wikie users list|remove")
+	}
+	switch args[0] {
+	case "list":
+		return usersList(config, args[1:])
+	case "remove":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: wikie users remove <user>")
+		}
+		for _, admin := range config.Admins {
+			if admin == args[1] {
+				return fmt.Errorf("%s is an admin in the configuration, remove them from it first", admin)
+			}
+		}
+		db, err := openDB(false)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return wikie.RemoveUser(db, args[1])
+	default:
+		return fmt.Errorf("unknown users command %s", args[0])
+	}
+}
+
+func usersList(config wikie.Config, args []string) error {
+	flags := flag.NewFlagSet("users list", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "write the users as JSON")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	userPerms, err := wikie.GetPermissions(db)
+	if err != nil {
+		return err
+	}
+	logins, err := wikie.GetSessions(db)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]*userEntry)
+	entry := func(user string) *userEntry {
+		if _, ok := known[user]; !ok {
+			known[user] = &userEntry{User: user}
+		}
+		return known[user]
+	}
+	for _, admin := range config.Admins {
+		entry(admin).Admin = true
+	}
+	for user, perms := range userPerms {
+		entry(user).Paths = len(perms)
+	}
+	for _, login := range logins {
+		entry(login.User).Sessions++
+	}
+
+	entries := make([]userEntry, 0, len(known))
+	for _, e := range known {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].User < entries[j].User
+	})
+	var rows [][]string
+	for _, e := range entries {
+		role := "user"
+		if e.Admin {
+			role = "admin"
+		}
+		rows = append(rows, []string{e.User, role, strconv.Itoa(e.Paths), strconv.Itoa(e.Sessions)})
+	}
+	return list(*asJSON, entries, rows)
+}
+
+// loginSessions lists and revokes logins.
+func loginSessions(config wikie.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: wikie sessions list|revoke")
+	}
+	switch args[0] {
+	case "list":
+		return sessionsList(args[1:])
+	case "revoke":
+		return sessionsRevoke(args[1:])
+	default:
+		return fmt.Errorf("unknown sessions command %s", args[0])
+	}
+}
+
+func sessionRows(logins []wikie.Session) [][]string {
+	var rows [][]string
+	for _, login := range logins {
+		rows = append(rows, []string{login.Token, login.User, login.Created.Format(time.RFC3339)})
+	}
+	return rows
+}
+
+func sessionsList(args []string) error {
+	flags := flag.NewFlagSet("sessions list", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "write the sessions as JSON")
+	user := flags.String("user", "", "only list the sessions of this user")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	all, err := wikie.GetSessions(db)
+	if err != nil {
+		return err
+	}
+	logins := make([]wikie.Session, 0, len(all))
+	for _, login := range all {
+		if len(*user) == 0 || login.User == *user {
+			logins = append(logins, login)
+		}
+	}
+	return list(*asJSON, logins, sessionRows(logins))
+}
+
+// sessionsRevoke logs out the sessions given by token, or those of a user, and
+// lists the sessions revoked.
+func sessionsRevoke(args []string) error {
+	flags := flag.NewFlagSet("sessions revoke", flag.ContinueOnError)
+	user := flags.String("user", "", "revoke every session of this user")
+	all := flags.Bool("all", false, "revoke every session")
+	asJSON := flags.Bool("json", false, "write the sessions revoked as JSON")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() == 0 && len(*user) == 0 && !*all {
+		return fmt.Errorf("usage: wikie sessions revoke [-json] -all | -user <user> | <token>...")
+	}
+	tokens := make(map[string]bool)
+	for _, token := range flags.Args() {
+		tokens[token] = true
+	}
+
+	db, err := openDB(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	revoked, err := wikie.RemoveSessions(db, func(login wikie.Session) bool {
+		return *all || tokens[login.Token] || (len(*user) > 0 && login.User == *user)
+	})
+	if err != nil {
+		return err
+	}
+	if revoked == nil {
+		revoked = []wikie.Session{}
+	}
+	return list(*asJSON, revoked, sessionRows(revoked))
+}
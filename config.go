@@ -24,7 +24,34 @@ type RocketChatConfig struct {
 }
 
 type ElasticsearchConfig struct {
-	Hosts []string `yaml:"hosts"`
+	Hosts        []string `yaml:"hosts"`
+	Distribution string   `yaml:"distribution"`
+	Username     string   `yaml:"username"`
+	Password     string   `yaml:"password"`
+	Languages    []string `yaml:"languages"`
+}
+
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	Region    string `yaml:"region"`
+	AccessKey string `yaml:"accessKey"`
+	SecretKey string `yaml:"secretKey"`
+	SSL       bool   `yaml:"ssl"`
+}
+
+type StorageConfig struct {
+	Backend string        `yaml:"backend"`
+	Path    string        `yaml:"path"`
+	S3      S3Config      `yaml:"s3"`
+	Limits  StorageLimits `yaml:"limits"`
+}
+
+type GitConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Path     string `yaml:"path"`
+	Interval string `yaml:"interval"`
 }
 
 type Config struct {
@@ -32,8 +59,11 @@ type Config struct {
 	RocketChatConfig    RocketChatConfig    `yaml:"rocket.chat"`
 	Admins              []string            `yaml:"admins"`
 	CookieSecret        string              `yaml:"cookieSecret"`
+	ShareSecret         string              `yaml:"shareSecret"`
 	OAuth2Config        *OAuth2Config       `yaml:"oauth2"`
 	ElasticsearchConfig ElasticsearchConfig `yaml:"elasticsearch"`
+	StorageConfig       StorageConfig       `yaml:"storage"`
+	GitConfig           GitConfig           `yaml:"git"`
 }
 
 func ReadConfig(file string) (config Config, err error) {
@@ -52,5 +82,24 @@ func ReadConfig(file string) (config Config, err error) {
 		return
 	}
 
+	if len(config.ShareSecret) == 0 {
+		config.ShareSecret = config.CookieSecret
+	}
+
+	if len(config.GitConfig.Path) == 0 {
+		config.GitConfig.Path = "pages.git"
+	}
+	if len(config.GitConfig.Interval) == 0 {
+		config.GitConfig.Interval = "10s"
+	}
+
+	if len(config.ElasticsearchConfig.Distribution) == 0 {
+		config.ElasticsearchConfig.Distribution = DistributionElasticsearch
+	}
+	if _, ok := supportedVersions[config.ElasticsearchConfig.Distribution]; !ok {
+		err = fmt.Errorf("elasticsearch distribution must be either `%s` or `%s`", DistributionElasticsearch, DistributionOpenSearch)
+		return
+	}
+
 	return
 }
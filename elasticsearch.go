@@ -3,23 +3,127 @@ package wikie
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/go-errors/errors"
-	"gopkg.in/olivere/elastic.v5"
+	"github.com/olivere/elastic/v7"
+	"html/template"
+	"io"
+	"path"
+	"sort"
 	"strings"
 )
 
+const (
+	// suggestSize is the number of pages suggested while typing.
+	suggestSize = 8
+	// snippetFragmentSize is the number of characters in each highlighted fragment.
+	snippetFragmentSize = 125
+	// facetSize is the maximum number of values returned for each facet.
+	facetSize = 10
+	// maxPublicPages is the most pages listed in the public site's index.
+	maxPublicPages = 10000
+)
+
+// SearchResult is a page or attachment matched by a search along with a
+// snippet of its body. For attachments, Page is the page it belongs to.
+type SearchResult struct {
+	Page       Page
+	Attachment *Attachment
+	Snippet    template.HTML
+}
+
+// Facet is the number of matching pages which share a value for a field.
+type Facet struct {
+	Value string
+	Count int64
+}
+
+// SearchResults is one page of search results, the total number of hits and
+// the facet counts over all of them.
+type SearchResults struct {
+	Total      int64
+	Results    []SearchResult
+	Namespaces []Facet
+	Authors    []Facet
+	Tags       []Facet
+	Public     []Facet
+}
+
+// Suggestion is a link to a page, offered while a path or title is being typed
+// or as a page related to the one being read.
+type Suggestion struct {
+	Path  string `json:"path"`
+	Title string `json:"title"`
+}
+
+// ErrPageChanged is returned when a page was created or changed by someone
+// else between reading it and saving it.
+var ErrPageChanged = errors.New("page changed since it was read")
+
 func NewPage(client *elastic.Client, path string, page Page) error {
-	_, err := client.Index().Index("wikie").Id(path).BodyJson(page).Type("page").Do(context.Background())
+	page.Title = page.title()
+	_, err := client.Index().Index(PageIndex).Id(path).BodyJson(page).Do(context.Background())
 	return err
 }
 
 func UpdatePage(client *elastic.Client, path string, page Page) error {
-	_, err := client.Update().Index("wikie").Id(path).Doc(page).Type("page").Do(context.Background())
+	// The path is part of the partial document, so keep it in step with the id
+	// that search filters on.
+	page.Path = path
+	page.Title = page.title()
+	_, err := client.Update().Index(PageIndex).Id(path).Doc(page).Do(context.Background())
+	return err
+}
+
+// CreatePage saves a new page, failing with ErrPageChanged if a page was saved
+// at path in the meantime.
+func CreatePage(client *elastic.Client, path string, page Page) error {
+	page.Title = page.title()
+	_, err := client.Index().Index(PageIndex).Id(path).OpType("create").BodyJson(page).Do(context.Background())
+	if elastic.IsConflict(err) {
+		return ErrPageChanged
+	}
+	return err
+}
+
+// UpdatePageIf updates the page read as current, failing with ErrPageChanged if
+// it has been saved since.
+func UpdatePageIf(client *elastic.Client, path string, page Page, current Page) error {
+	page.Path = path
+	page.Title = page.title()
+	_, err := client.Update().Index(PageIndex).Id(path).Doc(page).
+		IfSeqNo(current.SeqNo).
+		IfPrimaryTerm(current.PrimaryTerm).
+		Do(context.Background())
+	if elastic.IsConflict(err) {
+		return ErrPageChanged
+	}
+	return err
+}
+
+func DeletePage(client *elastic.Client, pagePath string) error {
+	_, err := client.Delete().Index(PageIndex).Id(pagePath).Do(context.Background())
+	if elastic.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func IndexAttachment(client *elastic.Client, attachment Attachment) error {
+	_, err := client.Index().Index(AttachmentIndex).Id(attachment.Path).BodyJson(attachment).Do(context.Background())
+	return err
+}
+
+func DeleteAttachment(client *elastic.Client, filePath string) error {
+	_, err := client.Delete().Index(AttachmentIndex).Id(filePath).Do(context.Background())
+	if elastic.IsNotFound(err) {
+		return nil
+	}
 	return err
 }
 
 func GetPage(client *elastic.Client, pagePath string) (Page, error) {
-	result, err := client.Get().Index("wikie").Id(pagePath).Do(context.Background())
+	result, err := client.Get().Index(PageIndex).Id(pagePath).Do(context.Background())
 	if err != nil {
 		return Page{}, err
 	}
@@ -32,14 +136,298 @@ func GetPage(client *elastic.Client, pagePath string) (Page, error) {
 	if err != nil {
 		return Page{}, err
 	}
+	page, err := decodePage(pagePath, b)
+	if err != nil {
+		return Page{}, err
+	}
+	if result.Version != nil {
+		page.Version = *result.Version
+	}
+	if result.SeqNo != nil && result.PrimaryTerm != nil {
+		page.SeqNo = *result.SeqNo
+		page.PrimaryTerm = *result.PrimaryTerm
+	}
+	return page, nil
+}
+
+// RelatedPages returns up to size pages with bodies and tags similar to the
+// page at pagePath. Permissions are not considered; callers filter the pages.
+func RelatedPages(client *elastic.Client, pagePath string, size int) ([]Suggestion, error) {
+	q := elastic.NewMoreLikeThisQuery().
+		Field("body", "tags").
+		LikeItems(elastic.NewMoreLikeThisQueryItem().Index(PageIndex).Id(pagePath)).
+		MinTermFreq(1).
+		MinDocFreq(2).
+		MaxQueryTerms(25)
+
+	result, err := client.Search(PageIndex).
+		Query(q).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("path", "title")).
+		Size(size).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return suggestions(result)
+}
+
+// SearchPages runs query against the page and attachment indices and returns
+// each hit together with the highlighted fragments of its body, so no further
+// lookups are needed. Only documents under one of the readable path prefixes
+// are matched, so the total and the facet counts reflect what the user is able
+// to see.
+func SearchPages(client *elastic.Client, query SearchQuery, readable []string, from, size int) (SearchResults, error) {
+	if len(readable) == 0 {
+		return SearchResults{}, nil
+	}
+
+	q := elastic.NewBoolQuery().Filter(readableFilter(readable))
+	if len(query.Text) > 0 {
+		q.Must(elastic.NewSimpleQueryStringQuery(query.Text).Field("title^2").Field("path.text").Field("name").Field("tags").Field("body").Field("body.*"))
+	} else {
+		q.Must(elastic.NewMatchAllQuery())
+	}
+	if len(query.Namespace) > 0 && query.Namespace != "/" {
+		q.Filter(elastic.NewBoolQuery().MinimumNumberShouldMatch(1).Should(
+			elastic.NewTermQuery("path", query.Namespace),
+			elastic.NewPrefixQuery("path", query.Namespace+"/"),
+		))
+	}
+	if len(query.Author) > 0 {
+		q.Filter(elastic.NewTermQuery("edited", query.Author))
+	}
+	for _, tag := range query.Tags {
+		q.Filter(elastic.NewTermQuery("tags", tag))
+	}
+	if len(query.Public) > 0 {
+		q.Filter(elastic.NewTermQuery("public", query.Public == "true"))
+	}
+	if !query.After.IsZero() || !query.Before.IsZero() {
+		updated := elastic.NewRangeQuery("updated").Format("yyyy-MM-dd")
+		if !query.After.IsZero() {
+			updated.Gte(query.After.Format(searchDateLayout))
+		}
+		if !query.Before.IsZero() {
+			updated.Lt(query.Before.Format(searchDateLayout))
+		}
+		q.Filter(updated)
+	}
+
+	highlight := elastic.NewHighlight().
+		Field("body").
+		Encoder("html").
+		PreTags("<b>").
+		PostTags("</b>").
+		RequireFieldMatch(false).
+		FragmentSize(snippetFragmentSize).
+		NumOfFragments(2).
+		NoMatchSize(snippetFragmentSize)
+
+	// The namespace facet counts pages one level below the current namespace.
+	namespace := strings.TrimSuffix(query.Namespace, "/")
+	namespaces := elastic.NewScript(`if (doc['path'].empty) { return null; }
+String p = doc['path'].value;
+int i = p.indexOf('/', params.offset);
+return i < 0 ? p : p.substring(0, i);`).Lang("painless").Param("offset", len(namespace)+1)
+
+	result, err := client.Search(PageIndex, AttachmentIndex).
+		Query(q).
+		Highlight(highlight).
+		Aggregation("namespaces", elastic.NewTermsAggregation().Script(namespaces).Size(facetSize)).
+		Aggregation("authors", elastic.NewTermsAggregation().Field("edited").Size(facetSize)).
+		Aggregation("tags", elastic.NewTermsAggregation().Field("tags").Size(facetSize)).
+		Aggregation("public", elastic.NewTermsAggregation().Field("public")).
+		From(from).
+		Size(size).
+		TrackTotalHits(true).
+		Do(context.Background())
+	if err != nil {
+		return SearchResults{}, err
+	}
+
+	results := SearchResults{
+		Total:      result.TotalHits(),
+		Namespaces: facets(result.Aggregations, "namespaces"),
+		Authors:    facets(result.Aggregations, "authors"),
+		Tags:       facets(result.Aggregations, "tags"),
+		Public:     facets(result.Aggregations, "public"),
+	}
+	for _, hit := range result.Hits.Hits {
+		if hit.Source == nil {
+			continue
+		}
+		b, err := hit.Source.MarshalJSON()
+		if err != nil {
+			return SearchResults{}, err
+		}
+		if isIndexOf(hit.Index, AttachmentIndex) {
+			var attachment Attachment
+			err := json.Unmarshal(b, &attachment)
+			if err != nil {
+				return SearchResults{}, err
+			}
+			results.Results = append(results.Results, SearchResult{
+				Page:       Page{Path: attachment.Page},
+				Attachment: &attachment,
+				Snippet:    snippet(hit.Highlight["body"]),
+			})
+			continue
+		}
+		page, err := decodePage(hit.Id, b)
+		if err != nil {
+			return SearchResults{}, err
+		}
+		results.Results = append(results.Results, SearchResult{
+			Page:    page,
+			Snippet: snippet(hit.Highlight["body"]),
+		})
+	}
+	return results, nil
+}
+
+// SuggestPages returns readable pages whose path or title starts with prefix.
+func SuggestPages(client *elastic.Client, prefix string, readable []string) ([]Suggestion, error) {
+	if len(readable) == 0 {
+		return nil, nil
+	}
+
+	q := elastic.NewBoolQuery().
+		Filter(readableFilter(readable)).
+		MinimumNumberShouldMatch(1).
+		Should(
+			elastic.NewMultiMatchQuery(prefix, "path.suggest", "title.suggest").Operator("and"),
+			elastic.NewPrefixQuery("path", "/"+strings.TrimPrefix(prefix, "/")).Boost(2),
+		)
+
+	result, err := client.Search(PageIndex).
+		Query(q).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("path", "title")).
+		Size(suggestSize).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return suggestions(result)
+}
+
+// AllPages returns every page under the namespaces, or every page when none
+// are given. With publicOnly, only public pages are returned.
+func AllPages(client *elastic.Client, namespaces []string, publicOnly bool) ([]Page, error) {
+	q := elastic.NewBoolQuery().Must(elastic.NewMatchAllQuery())
+	if len(namespaces) > 0 {
+		under := elastic.NewBoolQuery().MinimumNumberShouldMatch(1)
+		for _, namespace := range namespaces {
+			namespace = "/" + strings.Trim(namespace, "/")
+			under.Should(elastic.NewTermQuery("path", namespace))
+			under.Should(elastic.NewPrefixQuery("path", strings.TrimSuffix(namespace, "/")+"/"))
+		}
+		q.Filter(under)
+	}
+	if publicOnly {
+		q.Filter(elastic.NewTermQuery("public", true))
+	}
+
+	var pages []Page
+	scroll := client.Scroll(PageIndex).Query(q).Size(100)
+	defer scroll.Clear(context.Background())
+	for {
+		result, err := scroll.Do(context.Background())
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		for _, hit := range result.Hits.Hits {
+			if hit.Source == nil {
+				continue
+			}
+			page, err := decodePage(hit.Id, hit.Source)
+			if err != nil {
+				return nil, err
+			}
+			pages = append(pages, page)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].Path < pages[j].Path
+	})
+	return pages, nil
+}
+
+// PublicPages returns every public page, sorted by path.
+func PublicPages(client *elastic.Client) ([]Suggestion, error) {
+	result, err := client.Search(PageIndex).
+		Query(elastic.NewTermQuery("public", true)).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("path", "title")).
+		Sort("path", true).
+		Size(maxPublicPages).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return suggestions(result)
+}
+
+func suggestions(result *elastic.SearchResult) ([]Suggestion, error) {
+	var suggestions []Suggestion
+	for _, hit := range result.Hits.Hits {
+		suggestion := Suggestion{Path: hit.Id}
+		if hit.Source != nil {
+			err := json.Unmarshal(hit.Source, &suggestion)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(suggestion.Title) == 0 {
+			suggestion.Title = path.Base(suggestion.Path)
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+	return suggestions, nil
+}
+
+// readableFilter matches pages under any of the readable path prefixes, as
+// UnderPath does.
+func readableFilter(readable []string) elastic.Query {
+	prefixes := elastic.NewBoolQuery().MinimumNumberShouldMatch(1)
+	for _, prefix := range readable {
+		prefix = strings.TrimSuffix(prefix, "/")
+		prefixes.Should(elastic.NewTermQuery("path", prefix))
+		prefixes.Should(elastic.NewPrefixQuery("path", prefix+"/"))
+	}
+	return prefixes
+}
+
+func facets(aggs elastic.Aggregations, name string) []Facet {
+	terms, ok := aggs.Terms(name)
+	if !ok {
+		return nil
+	}
+	var f []Facet
+	for _, bucket := range terms.Buckets {
+		value := fmt.Sprint(bucket.Key)
+		if bucket.KeyAsString != nil {
+			value = *bucket.KeyAsString
+		}
+		f = append(f, Facet{Value: value, Count: bucket.DocCount})
+	}
+	return f
+}
+
+func decodePage(pagePath string, source []byte) (Page, error) {
 	var i map[string]interface{}
-	err = json.Unmarshal(b, &i)
+	err := json.Unmarshal(source, &i)
 	if err != nil {
 		return Page{}, err
 	}
 	var page Page
 	page.Body = i["body"].(string)
 	page.Path = pagePath
+	if v, ok := i["title"].(string); ok {
+		page.Title = v
+	}
 	rel := strings.Split(pagePath, "/")[1:]
 	for i := 0; i < len(rel); i++ {
 		page.Relationships = append(page.Relationships, PageRelationship{
@@ -47,10 +435,31 @@ func GetPage(client *elastic.Client, pagePath string) (Page, error) {
 			Title: rel[i],
 		})
 	}
-	page.LastUpdated = i["updated"].(string)
+	if v, ok := i["updated"].(string); ok {
+		page.LastUpdated, err = ParseTimestamp(v)
+		if err != nil {
+			return Page{}, err
+		}
+	}
 	page.EditedBy = i["edited"].(string)
 	if v, ok := i["public"]; ok {
 		page.Public = v.(bool)
 	}
+	if v, ok := i["tags"].([]interface{}); ok {
+		for _, tag := range v {
+			if t, ok := tag.(string); ok {
+				page.Tags = append(page.Tags, t)
+			}
+		}
+	}
 	return page, nil
 }
+
+// snippet joins highlighted fragments. The highlighter uses the html encoder, so
+// the fragments are already escaped apart from the <b> tags around matches.
+func snippet(fragments []string) template.HTML {
+	if len(fragments) == 0 {
+		return ""
+	}
+	return template.HTML("..." + strings.Join(fragments, "...") + "...")
+}
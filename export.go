@@ -0,0 +1,308 @@
+package wikie
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// searchIndexText is the most text of each page put in a static site's search index.
+const searchIndexText = 5000
+
+type staticNav struct {
+	Title   string
+	URL     string
+	Depth   int
+	Current bool
+}
+
+type staticPage struct {
+	Title    string
+	Path     string
+	Root     string
+	Body     template.HTML
+	Nav      []staticNav
+	EditedBy string
+	Updated  time.Time
+}
+
+type staticSearchEntry struct {
+	Title string `json:"title"`
+	Path  string `json:"path"`
+	URL   string `json:"url"`
+	Text  string `json:"text"`
+}
+
+// ExportStatic writes pages to dir as a static html site that can be served
+// by any web server, or read straight from disk. Links between the pages are
+// made relative, files uploaded to the pages are copied into the site, and
+// links to anything not exported become plain text. When published is given,
+// only the files it is true for are copied. Progress is written to w.
+func ExportStatic(ctx context.Context, pages []Page, blobs BlobStore, published func(filePath string) bool, dir string, w io.Writer) error {
+	exported := make(map[string]bool)
+	var suggestions []Suggestion
+	for _, page := range pages {
+		// Pages are written to files named after their paths.
+		if err := CheckPagePath(page.Path); err != nil {
+			return fmt.Errorf("%w: %q", err, page.Path)
+		}
+		exported[page.Path] = true
+		suggestions = append(suggestions, Suggestion{Path: page.Path, Title: page.Title})
+	}
+	tree := PageTree(suggestions)
+
+	var search []staticSearchEntry
+	files := make(map[string]bool)
+	for _, page := range pages {
+		root := staticRoot(page.Path)
+		body := staticLinks(string(page.Render()), page.Path, root, exported, files, published)
+
+		text, err := htmlText(strings.NewReader(body))
+		if err != nil {
+			return err
+		}
+		if len(text) > searchIndexText {
+			text = text[:searchIndexText]
+		}
+		search = append(search, staticSearchEntry{Title: page.Title, Path: page.Path, URL: staticPageURL("", page.Path), Text: strings.Join(strings.Fields(text), " ")})
+
+		err = writeStaticPage(filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(page.Path, "/")), "index.html"), staticPage{
+			Title:    page.Title,
+			Path:     page.Path,
+			Root:     root,
+			Body:     template.HTML(body),
+			Nav:      staticNavigation(tree, root, page.Path),
+			EditedBy: page.EditedBy,
+			Updated:  page.LastUpdated,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "exported %s\n", page.Path)
+	}
+
+	// The root page, if there is one, is the index of the site.
+	if !exported["/"] {
+		err := writeStaticPage(filepath.Join(dir, "index.html"), staticPage{Title: "Index", Path: "/", Nav: staticNavigation(tree, "", "")})
+		if err != nil {
+			return err
+		}
+	}
+
+	for filePath := range files {
+		err := copyStaticFile(ctx, blobs, filePath, filepath.Join(dir, "storage", filepath.FromSlash(StorageKey(filePath))))
+		if err == ErrBlobNotFound {
+			fmt.Fprintf(w, "skipped missing file %s\n", filePath)
+			continue
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "copied %s\n", filePath)
+	}
+
+	// The index is a script rather than JSON so that it also loads when the
+	// site is opened from disk.
+	b, err := json.Marshal(search)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "search-index.js"), []byte("var wikieSearchIndex = "+string(b)+";\n"), 0644)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "search.js"), []byte(staticSearchScript), 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "exported %d pages and %d files to %s\n", len(pages), len(files), dir)
+	return nil
+}
+
+// staticRoot is the relative URL of the root of the site from a page.
+func staticRoot(pagePath string) string {
+	if pagePath == "/" {
+		return ""
+	}
+	return strings.Repeat("../", len(strings.Split(strings.Trim(pagePath, "/"), "/")))
+}
+
+func staticPageURL(root, pagePath string) string {
+	if pagePath == "/" {
+		return root + "index.html"
+	}
+	return root + strings.TrimPrefix(pagePath, "/") + "/index.html"
+}
+
+// staticLinks rewrites the links and images in body, rendered from the page
+// at pagePath, to point within the site. The files they use are added to files.
+func staticLinks(body, pagePath, root string, exported, files map[string]bool, published func(string) bool) string {
+	return rewriteLinks(body, pagePath, func(target, fragment string) (string, bool) {
+		if !exported[target] {
+			return "", false
+		}
+		href := staticPageURL(root, target)
+		if len(fragment) > 0 {
+			href += "#" + fragment
+		}
+		return href, true
+	}, func(target string) (string, bool) {
+		// A file is exported along with the page it was uploaded to.
+		if !exported[path.Dir(target)] || (published != nil && !published(target)) {
+			return "", false
+		}
+		files[target] = true
+		return root + "storage/" + StorageKey(target), true
+	})
+}
+
+func staticNavigation(tree []PageTreeEntry, root, current string) []staticNav {
+	var nav []staticNav
+	for _, entry := range tree {
+		nav = append(nav, staticNav{
+			Title:   entry.Title,
+			URL:     staticPageURL(root, entry.Path),
+			Depth:   entry.Depth,
+			Current: entry.Path == current,
+		})
+	}
+	return nav
+}
+
+func writeStaticPage(name string, page staticPage) error {
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = staticTemplate.Execute(f, page)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func copyStaticFile(ctx context.Context, blobs BlobStore, filePath, name string) error {
+	r, _, err := blobs.Open(ctx, StorageKey(filePath))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	err = os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+var staticTemplate = template.Must(template.New("static").Funcs(template.FuncMap{
+	"indent": func(depth int) template.CSS {
+		return template.CSS(fmt.Sprintf("padding-left: %dem", depth))
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>{{ .Title }}</title>
+    <style>
+        body { margin: 0; font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; line-height: 1.5; color: #111; }
+        nav { position: fixed; top: 0; bottom: 0; width: 260px; overflow-y: auto; padding: 16px; border-right: 1px solid #ddd; box-sizing: border-box; }
+        nav ul { list-style: none; padding: 0; }
+        nav a { color: #0074d9; text-decoration: none; }
+        nav .current { font-weight: bold; }
+        main { margin-left: 260px; max-width: 960px; padding: 32px; }
+        img { max-width: 100%; }
+        pre { overflow-x: auto; background: #f6f6f6; padding: 8px; }
+        input[type=search] { width: 100%; box-sizing: border-box; padding: 4px; }
+        #search-results li { margin-bottom: 8px; }
+        @media only screen and (max-width: 720px) { nav { position: static; width: auto; border: none; } main { margin: 0; } }
+    </style>
+</head>
+<body>
+<nav>
+    <a href="{{ .Root }}index.html"><b>Index</b></a>
+    <input type="search" id="search" placeholder="search" autocomplete="off">
+    <ul>
+        {{ range .Nav }}<li style="{{ indent .Depth }}"><a href="{{ .URL }}"{{ if .Current }} class="current"{{ end }}>{{ .Title }}</a></li>{{ end }}
+    </ul>
+</nav>
+<main>
+    <ol id="search-results" hidden></ol>
+    <div id="content">
+        {{ if .Body }}
+            {{ .Body }}
+            <hr>
+            <small>Last edit by <em>{{ .EditedBy }}</em> on {{ .Updated.Format "2 January 2006" }}.</small>
+        {{ else }}
+            <h1>Index</h1>
+            <ul>
+                {{ range .Nav }}<li style="{{ indent .Depth }}"><a href="{{ .URL }}">{{ .Title }}</a></li>{{ end }}
+            </ul>
+        {{ end }}
+    </div>
+</main>
+<script>var wikieRoot = "{{ .Root }}";</script>
+<script src="{{ .Root }}search-index.js"></script>
+<script src="{{ .Root }}search.js"></script>
+</body>
+</html>
+`))
+
+// staticSearchScript searches the index of a static site as the visitor types.
+const staticSearchScript = `(function () {
+    var input = document.getElementById("search");
+    var results = document.getElementById("search-results");
+    var content = document.getElementById("content");
+    input.addEventListener("input", function () {
+        var terms = input.value.toLowerCase().split(/\s+/).filter(function (t) { return t.length > 0; });
+        results.innerHTML = "";
+        if (terms.length === 0) {
+            results.hidden = true;
+            content.hidden = false;
+            return;
+        }
+        var matches = wikieSearchIndex.filter(function (page) {
+            var text = (page.title + " " + page.path + " " + page.text).toLowerCase();
+            return terms.every(function (t) { return text.indexOf(t) >= 0; });
+        }).slice(0, 20);
+        matches.forEach(function (page) {
+            var li = document.createElement("li");
+            var a = document.createElement("a");
+            a.href = wikieRoot + page.url;
+            a.textContent = page.title;
+            li.appendChild(a);
+            var i = page.text.toLowerCase().indexOf(terms[0]);
+            if (i >= 0) {
+                var snippet = document.createElement("div");
+                snippet.textContent = "..." + page.text.substring(Math.max(0, i - 60), i + 100) + "...";
+                li.appendChild(snippet);
+            }
+            results.appendChild(li);
+        });
+        if (matches.length === 0) {
+            results.innerHTML = "<li>No pages found.</li>";
+        }
+        results.hidden = false;
+        content.hidden = true;
+    });
+})();
+`
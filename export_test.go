@@ -0,0 +1,27 @@
+package wikie
+
+import "testing"
+
+func TestStaticLinks(t *testing.T) {
+	exported := map[string]bool{"/a": true, "/a/b": true}
+	published := func(filePath string) bool {
+		return filePath == "/a/p.png"
+	}
+	for _, test := range []struct {
+		body, want string
+		published  func(string) bool
+	}{
+		{`<a href="/w/a/b#x">b</a>`, `<a href="../a/b/index.html#x">b</a>`, nil},
+		{`<a href="/w/c">c</a>`, `c`, nil},
+		{`<a href="/storage/a/f.pdf">f</a>`, `<a href="../storage/a/f.pdf">f</a>`, nil},
+		// Unpublished files are left out when only published ones are exported.
+		{`<a href="/storage/a/f.pdf">f</a>`, `f`, published},
+		{`<img src="/storage/a/p.png" alt="p">`, `<img src="../storage/a/p.png" alt="p">`, published},
+		{`<a href="/storage/c/f.pdf">f</a>`, `f`, nil},
+	} {
+		files := make(map[string]bool)
+		if got := staticLinks(test.body, "/a", "../", exported, files, test.published); got != test.want {
+			t.Errorf("staticLinks(%s) = %s, want %s", test.body, got, test.want)
+		}
+	}
+}
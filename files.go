@@ -0,0 +1,522 @@
+package wikie
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// versionsPrefix is where the contents of every version of every file are
+// kept, named by their hash. Users cannot reach it as ResolveStoragePath
+// rejects hidden path elements.
+const versionsPrefix = ".versions/"
+
+// uploadsPrefix is where uploads are kept until they have been recorded.
+const uploadsPrefix = ".uploads/"
+
+// FileVersion is one upload of a file to storage.
+type FileVersion struct {
+	Version  int       `json:"version"`
+	Hash     string    `json:"hash"`
+	Size     int64     `json:"size"`
+	Uploader string    `json:"uploader"`
+	Uploaded time.Time `json:"uploaded"`
+	// RestoredFrom is the version this one restored, if any.
+	RestoredFrom int `json:"restoredFrom,omitempty"`
+}
+
+// FileHistory is every version of a file in storage, oldest first.
+type FileHistory struct {
+	Path     string        `json:"path"`
+	Versions []FileVersion `json:"versions"`
+	// Public files can be read without an account, from the public site.
+	Public bool `json:"public,omitempty"`
+}
+
+// Current is the version of the file that is served.
+func (h FileHistory) Current() FileVersion {
+	if len(h.Versions) == 0 {
+		return FileVersion{}
+	}
+	return h.Versions[len(h.Versions)-1]
+}
+
+// Previous are the versions of the file which are no longer served, newest first.
+func (h FileHistory) Previous() []FileVersion {
+	var previous []FileVersion
+	for i := len(h.Versions) - 2; i >= 0; i-- {
+		previous = append(previous, h.Versions[i])
+	}
+	return previous
+}
+
+func GetFileHistory(db *bolt.DB, filePath string) (FileHistory, error) {
+	history := FileHistory{Path: filePath}
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("files"))
+		if v := bucket.Get([]byte(filePath)); v != nil {
+			return json.Unmarshal(v, &history)
+		}
+		return nil
+	})
+	return history, err
+}
+
+// AddFileVersion records a new version of a file, numbering it after the
+// versions already recorded.
+func AddFileVersion(db *bolt.DB, filePath string, version FileVersion) (FileVersion, error) {
+	return addFileVersion(db, filePath, version, nil)
+}
+
+// addFileVersion records a version as AddFileVersion does, once check, if
+// given, allows a file of its size in the same transaction.
+func addFileVersion(db *bolt.DB, filePath string, version FileVersion, check StorageCheck) (FileVersion, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if check != nil {
+			err := check(tx, version.Size)
+			if err != nil {
+				return err
+			}
+		}
+		var err error
+		version, err = putFileVersion(tx, filePath, version)
+		if err != nil {
+			return err
+		}
+		return countUsage(tx, filePath, version.Uploader, version.Size)
+	})
+	return version, err
+}
+
+func putFileVersion(tx *bolt.Tx, filePath string, version FileVersion) (FileVersion, error) {
+	bucket := tx.Bucket([]byte("files"))
+	history := FileHistory{Path: filePath}
+	if v := bucket.Get([]byte(filePath)); v != nil {
+		err := json.Unmarshal(v, &history)
+		if err != nil {
+			return version, err
+		}
+	}
+	version.Version = history.Current().Version + 1
+	history.Versions = append(history.Versions, version)
+	b, err := json.Marshal(history)
+	if err != nil {
+		return version, err
+	}
+	return version, bucket.Put([]byte(filePath), b)
+}
+
+// DeleteFileHistory removes the history of a file, and its versions from the
+// storage totals.
+func DeleteFileHistory(db *bolt.DB, filePath string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("files"))
+		v := bucket.Get([]byte(filePath))
+		if v == nil {
+			return nil
+		}
+		var history FileHistory
+		err := json.Unmarshal(v, &history)
+		if err != nil {
+			return err
+		}
+		for _, version := range history.Versions {
+			err := countUsage(tx, filePath, version.Uploader, -version.Size)
+			if err != nil {
+				return err
+			}
+		}
+		return bucket.Delete([]byte(filePath))
+	})
+}
+
+// fileHashes returns how many versions of all files have each hash.
+func fileHashes(db *bolt.DB) (map[string]int, error) {
+	hashes := make(map[string]int)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("files")).ForEach(func(k, v []byte) error {
+			var history FileHistory
+			err := json.Unmarshal(v, &history)
+			if err != nil {
+				return err
+			}
+			for _, version := range history.Versions {
+				hashes[version.Hash]++
+			}
+			return nil
+		})
+	})
+	return hashes, err
+}
+
+// StorageCheck is run in the transaction which records a new version of a
+// file of size, and refuses it by returning an error.
+type StorageCheck func(tx *bolt.Tx, size int64) error
+
+// StoreFile writes r to storage at filePath (as returned by
+// ResolveStoragePath) as a new version of the file. Earlier versions are kept.
+// The upload is kept aside until check, if given, allows it, so that a file
+// which is refused never replaces the current one.
+func StoreFile(ctx context.Context, db *bolt.DB, blobs BlobStore, filePath string, r io.Reader, contentType, user string, check StorageCheck) (FileVersion, error) {
+	key := StorageKey(filePath)
+	history, err := GetFileHistory(db, filePath)
+	if err != nil {
+		return FileVersion{}, err
+	}
+
+	// A file uploaded before versions were kept has no history, so record
+	// what is there now before replacing it.
+	if len(history.Versions) == 0 {
+		err = recordLegacyFile(ctx, db, blobs, filePath)
+		if err != nil && err != ErrBlobNotFound {
+			return FileVersion{}, err
+		}
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	staged := uploadsPrefix + hex.EncodeToString(id)
+	defer blobs.Delete(ctx, staged)
+
+	h := sha256.New()
+	counter := &countingReader{r: io.TeeReader(r, h)}
+	err = blobs.Put(ctx, staged, counter, -1, contentType)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	// The content of the version is kept before it is recorded, so that the
+	// history never has a version whose content is missing.
+	kept := false
+	if _, err := blobs.Stat(ctx, versionsPrefix+hash); err == ErrBlobNotFound {
+		err = copyBlob(ctx, blobs, staged, versionsPrefix+hash, "")
+		if err != nil {
+			return FileVersion{}, err
+		}
+		kept = true
+	} else if err != nil {
+		return FileVersion{}, err
+	}
+
+	version, err := addFileVersion(db, filePath, FileVersion{
+		Hash:     hash,
+		Size:     counter.n,
+		Uploader: user,
+		Uploaded: time.Now(),
+	}, check)
+	if err != nil {
+		if kept {
+			deleteUnusedVersion(ctx, db, blobs, hash)
+		}
+		return FileVersion{}, err
+	}
+
+	err = copyBlob(ctx, blobs, staged, key, contentType)
+	if err != nil {
+		removeFileVersion(db, filePath, version.Version)
+		return FileVersion{}, err
+	}
+	return version, nil
+}
+
+// removeFileVersion takes back a version which was recorded but could not be
+// made the current file.
+func removeFileVersion(db *bolt.DB, filePath string, version int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("files"))
+		v := bucket.Get([]byte(filePath))
+		if v == nil {
+			return nil
+		}
+		var history FileHistory
+		err := json.Unmarshal(v, &history)
+		if err != nil {
+			return err
+		}
+		var versions []FileVersion
+		for _, v := range history.Versions {
+			if v.Version != version {
+				versions = append(versions, v)
+				continue
+			}
+			err := countUsage(tx, filePath, v.Uploader, -v.Size)
+			if err != nil {
+				return err
+			}
+		}
+		history.Versions = versions
+		b, err := json.Marshal(history)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(filePath), b)
+	})
+}
+
+// deleteUnusedVersion removes the content kept for a version which was
+// refused, unless another version has the same content.
+func deleteUnusedVersion(ctx context.Context, db *bolt.DB, blobs BlobStore, hash string) error {
+	hashes, err := fileHashes(db)
+	if err != nil {
+		return err
+	}
+	if hashes[hash] > 0 {
+		return nil
+	}
+	return blobs.Delete(ctx, versionsPrefix+hash)
+}
+
+// recordLegacyFile records the file at filePath, uploaded before versions
+// were kept, as its first version.
+func recordLegacyFile(ctx context.Context, db *bolt.DB, blobs BlobStore, filePath string) error {
+	key := StorageKey(filePath)
+	info, err := blobs.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	hash, err := keepVersion(ctx, blobs, key)
+	if err != nil {
+		return err
+	}
+	// It is already in the storage totals, counted from storage.
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := putFileVersion(tx, filePath, FileVersion{Hash: hash, Size: info.Size, Uploaded: info.ModTime})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// Its variants are made again under the hash of the version.
+	return deleteLegacyVariants(ctx, blobs, key)
+}
+
+// PublishFile sets whether the file at filePath can be read without an
+// account.
+func PublishFile(ctx context.Context, db *bolt.DB, blobs BlobStore, filePath string, public bool) error {
+	history, err := GetFileHistory(db, filePath)
+	if err != nil {
+		return err
+	}
+	// Only files with a history can be published.
+	if len(history.Versions) == 0 {
+		err = recordLegacyFile(ctx, db, blobs, filePath)
+		if err != nil {
+			return err
+		}
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("files"))
+		v := bucket.Get([]byte(filePath))
+		if v == nil {
+			return ErrBlobNotFound
+		}
+		var history FileHistory
+		err := json.Unmarshal(v, &history)
+		if err != nil {
+			return err
+		}
+		history.Public = public
+		b, err := json.Marshal(history)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(filePath), b)
+	})
+}
+
+// RestoreFile makes an earlier version of a file the current one. The restore
+// is itself recorded as a new version, once check, if given, allows it.
+func RestoreFile(ctx context.Context, db *bolt.DB, blobs BlobStore, filePath string, version int, user string, check StorageCheck) (FileVersion, error) {
+	history, err := GetFileHistory(db, filePath)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	for _, v := range history.Versions {
+		if v.Version != version {
+			continue
+		}
+		restored, err := addFileVersion(db, filePath, FileVersion{
+			Hash:         v.Hash,
+			Size:         v.Size,
+			Uploader:     user,
+			Uploaded:     time.Now(),
+			RestoredFrom: v.Version,
+		}, check)
+		if err != nil {
+			return FileVersion{}, err
+		}
+		err = copyBlob(ctx, blobs, versionsPrefix+v.Hash, StorageKey(filePath), "")
+		if err != nil {
+			removeFileVersion(db, filePath, restored.Version)
+			return FileVersion{}, err
+		}
+		return restored, nil
+	}
+	return FileVersion{}, fmt.Errorf("%s has no version %d", filePath, version)
+}
+
+// DeleteFile removes a file, its history, and any versions of it which are
+// not also versions of another file.
+func DeleteFile(ctx context.Context, db *bolt.DB, blobs BlobStore, filePath string) error {
+	history, err := GetFileHistory(db, filePath)
+	if err != nil {
+		return err
+	}
+	if len(history.Versions) == 0 {
+		// A file uploaded before histories were kept is counted from storage.
+		info, err := blobs.Stat(ctx, StorageKey(filePath))
+		if err == nil {
+			err = db.Update(func(tx *bolt.Tx) error {
+				return countUsage(tx, filePath, "", -info.Size)
+			})
+		}
+		if err != nil && err != ErrBlobNotFound {
+			return err
+		}
+	}
+	err = blobs.Delete(ctx, StorageKey(filePath))
+	if err != nil {
+		return err
+	}
+	err = DeleteFileHistory(db, filePath)
+	if err != nil {
+		return err
+	}
+	err = deleteLegacyVariants(ctx, blobs, StorageKey(filePath))
+	if err != nil {
+		return err
+	}
+
+	hashes, err := fileHashes(db)
+	if err != nil {
+		return err
+	}
+	for _, version := range history.Versions {
+		if hashes[version.Hash] == 0 {
+			err := blobs.Delete(ctx, versionsPrefix+version.Hash)
+			if err != nil {
+				return err
+			}
+			err = DeleteImageVariants(ctx, blobs, version.Hash)
+			if err != nil {
+				return err
+			}
+			// The same content may appear in several versions of this file.
+			hashes[version.Hash] = -1
+		}
+	}
+	return nil
+}
+
+// UniqueFilePath returns the path of a new file in namespace named after name,
+// which is tidied to be safe in a URL. When a file with that name already
+// exists, a random suffix is added.
+func UniqueFilePath(ctx context.Context, blobs BlobStore, namespace, name string) (string, error) {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '.', r == '-', r == '_':
+			return r
+		case unicode.IsSpace(r):
+			return '-'
+		}
+		return -1
+	}, path.Base(name))
+	name = strings.TrimLeft(name, ".")
+	if len(name) == 0 || name == "/" {
+		name = "file"
+	}
+	ext := path.Ext(name)
+
+	candidate := name
+	for i := 0; i < 10; i++ {
+		filePath, err := ResolveStoragePath(strings.TrimSuffix(namespace, "/") + "/" + candidate)
+		if err != nil {
+			return "", err
+		}
+		_, err = blobs.Stat(ctx, StorageKey(filePath))
+		if err == ErrBlobNotFound {
+			return filePath, nil
+		} else if err != nil {
+			return "", err
+		}
+		suffix := make([]byte, 3)
+		_, err = rand.Read(suffix)
+		if err != nil {
+			return "", err
+		}
+		candidate = strings.TrimSuffix(name, ext) + "-" + hex.EncodeToString(suffix) + ext
+	}
+	return "", fmt.Errorf("no free name for %s in %s", name, namespace)
+}
+
+// copyBlob copies the file at from to to.
+func copyBlob(ctx context.Context, blobs BlobStore, from, to, contentType string) error {
+	f, info, err := blobs.Open(ctx, from)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return blobs.Put(ctx, to, f, info.Size, contentType)
+}
+
+// keepVersion copies the file at key into the versions area, returning its hash.
+func keepVersion(ctx context.Context, blobs BlobStore, key string) (string, error) {
+	f, info, err := blobs.Open(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	err = blobs.Put(ctx, versionsPrefix+hash, f, info.Size, "")
+	f.Close()
+	return hash, err
+}
+
+// FormatSize formats a number of bytes for display, e.g. 1.5 MB.
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,78 @@
+package wikie
+
+import (
+	"context"
+	"github.com/boltdb/bolt"
+	"github.com/go-errors/errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStoreFile(t *testing.T) {
+	ctx := context.Background()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "perms.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = Init(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := NewLocalBlobStore(t.TempDir())
+
+	current := func() string {
+		r, _, err := blobs.Open(ctx, "a/f.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		b, _ := ioutil.ReadAll(r)
+		return string(b)
+	}
+
+	for _, body := range []string{"one", "two"} {
+		_, err := StoreFile(ctx, db, blobs, "/a/f.txt", strings.NewReader(body), "text/plain", "u", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := current(); got != "two" {
+		t.Errorf("current file = %q, want two", got)
+	}
+
+	errRefused := errors.New("refused")
+	_, err = StoreFile(ctx, db, blobs, "/a/f.txt", strings.NewReader("three"), "text/plain", "u", func(tx *bolt.Tx, size int64) error {
+		return errRefused
+	})
+	if err != errRefused {
+		t.Fatalf("StoreFile = %v, want the check's error", err)
+	}
+	if got := current(); got != "two" {
+		t.Errorf("refused upload replaced the file with %q", got)
+	}
+	history, err := GetFileHistory(db, "/a/f.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Versions) != 2 {
+		t.Errorf("%d versions after a refused upload, want 2", len(history.Versions))
+	}
+	versions, err := blobs.List(ctx, versionsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Errorf("%d versions kept after a refused upload, want 2", len(versions))
+	}
+
+	restored, err := RestoreFile(ctx, db, blobs, "/a/f.txt", 1, "u", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := current(); restored.Version != 3 || got != "one" {
+		t.Errorf("restored version %d as %q, want version 3 as one", restored.Version, got)
+	}
+}
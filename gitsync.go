@@ -0,0 +1,477 @@
+package wikie
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/olivere/elastic/v7"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gitBranch = "refs/heads/main"
+	// gitSynced is the commit whose pages are those in the index.
+	gitSynced = "refs/wikie/synced"
+	gitZero   = "0000000000000000000000000000000000000000"
+	// gitSaveAttempts is how many times a page save is committed before
+	// giving up when pushes keep moving the branch.
+	gitSaveAttempts = 3
+)
+
+// GitSync keeps the pages of the wiki in a bare git repository, as markdown
+// files named after their paths. Every page saved on the web is committed to
+// the main branch, and commits pushed to it are applied to the wiki by Sync.
+// A pushed change to a page which has also been edited on the web since the
+// last sync is not applied; the web edit is committed on top instead.
+type GitSync struct {
+	dir    string
+	client *elastic.Client
+	db     *bolt.DB
+	log    io.Writer
+	mu     sync.Mutex
+	// changed is whether pages were changed by a push since Sync last
+	// reported it.
+	changed bool
+}
+
+type gitChange struct {
+	status string
+	file   string
+}
+
+type gitPageMatter struct {
+	Tags   []string `yaml:"tags,omitempty"`
+	Public bool     `yaml:"public,omitempty"`
+}
+
+// OpenGitSync opens the repository at dir, creating it with every page in
+// the wiki if it does not exist yet. Conflicts and applied pushes are
+// written to log.
+func OpenGitSync(client *elastic.Client, db *bolt.DB, dir string, log io.Writer) (*GitSync, error) {
+	g := &GitSync{dir: dir, client: client, db: db, log: log}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		out, err := exec.Command("git", "init", "--quiet", "--bare", dir).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("could not create %s: %s", dir, strings.TrimSpace(string(out)))
+		}
+		// Pushes must build on the web edits, rather than replace them.
+		for _, args := range [][]string{{"symbolic-ref", "HEAD", gitBranch}, {"config", "receive.denyNonFastForwards", "true"}} {
+			_, err = g.git(nil, nil, args...)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(g.rev(gitSynced)) > 0 {
+		return g, nil
+	}
+	pages, err := AllPages(client, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	for _, page := range pages {
+		files[gitFile(page.Path)] = encodeGitPage(page)
+	}
+	main := g.rev(gitBranch)
+	commit, err := g.commit(main, files, "wikie", time.Now(), "Add the pages of the wiki")
+	if err != nil {
+		return nil, err
+	}
+	_, err = g.git(nil, nil, "update-ref", gitSynced, commit)
+	return g, err
+}
+
+// SavePage commits the page at pagePath as it is now in the wiki, after
+// applying anything which has been pushed.
+func (g *GitSync) SavePage(ctx context.Context, pagePath string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var commitErr error
+	for i := 0; i < gitSaveAttempts; i++ {
+		err := g.sync(ctx)
+		if err != nil {
+			return err
+		}
+		page, ok, err := g.page(ctx, pagePath)
+		if err != nil || !ok {
+			return err
+		}
+		commit, err := g.commit(g.rev(gitBranch), map[string][]byte{gitFile(pagePath): encodeGitPage(page)}, page.EditedBy, page.LastUpdated, "Edit "+pagePath)
+		if err == nil {
+			_, err = g.git(nil, nil, "update-ref", gitSynced, commit)
+			return err
+		}
+		// Something was pushed in the meantime.
+		commitErr = err
+	}
+	return commitErr
+}
+
+// RemovePage commits the removal of the page at pagePath by user, after
+// applying anything which has been pushed.
+func (g *GitSync) RemovePage(ctx context.Context, pagePath, user string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var commitErr error
+	for i := 0; i < gitSaveAttempts; i++ {
+		err := g.sync(ctx)
+		if err != nil {
+			return err
+		}
+		commit, err := g.commit(g.rev(gitBranch), map[string][]byte{gitFile(pagePath): nil}, user, time.Now(), "Delete "+pagePath)
+		if err == nil {
+			_, err = g.git(nil, nil, "update-ref", gitSynced, commit)
+			return err
+		}
+		commitErr = err
+	}
+	return commitErr
+}
+
+// Sync applies the commits pushed since the last sync to the wiki, and reports
+// whether any pages were changed since Sync last reported, including by the
+// syncs before each save.
+func (g *GitSync) Sync(ctx context.Context) (bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	err := g.sync(ctx)
+	changed := g.changed
+	g.changed = false
+	return changed, err
+}
+
+func (g *GitSync) sync(ctx context.Context) error {
+	main, synced := g.rev(gitBranch), g.rev(gitSynced)
+	if main == synced || len(main) == 0 {
+		return nil
+	}
+	changes, err := g.changes(synced, main)
+	if err != nil {
+		return err
+	}
+
+	conflicts := make(map[string][]byte)
+	for _, change := range changes {
+		pagePath, ok := gitPagePath(change.file)
+		if !ok {
+			continue
+		}
+		current, exists, err := g.page(ctx, pagePath)
+		if err != nil {
+			return err
+		}
+		b, inBase := g.blob(synced, change.file)
+		base, err := decodeGitPage(pagePath, b, "", time.Time{})
+		if err != nil {
+			return err
+		}
+		if exists != inBase || (exists && !samePage(current, base)) {
+			fmt.Fprintf(g.log, "git: %s was edited on the web since %.7s, keeping the web edit\n", pagePath, main)
+			conflicts[change.file] = nil
+			if exists {
+				conflicts[change.file] = encodeGitPage(current)
+			}
+			continue
+		}
+
+		if change.status == "D" {
+			err = DeletePage(g.client, pagePath)
+			if err != nil {
+				return err
+			}
+			g.changed = true
+			fmt.Fprintf(g.log, "git: deleted %s\n", pagePath)
+			continue
+		}
+		b, _ = g.blob(main, change.file)
+		author, when, subject := g.lastChange(synced, main, change.file)
+		if len(author) == 0 {
+			author = "git"
+		}
+		page, err := decodeGitPage(pagePath, b, author, when)
+		if err != nil {
+			fmt.Fprintf(g.log, "git: skipped %s: %v\n", change.file, err)
+			continue
+		}
+		// The page is only written if it is still the one compared above, so
+		// a web edit saved in the meantime is kept like any other conflict.
+		if exists {
+			err = UpdatePageIf(g.client, pagePath, page, current)
+		} else {
+			err = CreatePage(g.client, pagePath, page)
+		}
+		if err == ErrPageChanged {
+			fmt.Fprintf(g.log, "git: %s was edited on the web while syncing %.7s, keeping the web edit\n", pagePath, main)
+			current, exists, err = g.page(ctx, pagePath)
+			if err != nil {
+				return err
+			}
+			conflicts[change.file] = nil
+			if exists {
+				conflicts[change.file] = encodeGitPage(current)
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		g.changed = true
+		err = AddPageRevisions(g.db, pagePath, PageRevision{Body: page.Body, EditedBy: page.EditedBy, Updated: page.LastUpdated, Comment: subject})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(g.log, "git: updated %s from %.7s\n", pagePath, main)
+	}
+	_, err = g.git(nil, nil, "update-ref", gitSynced, main)
+	if err != nil || len(conflicts) == 0 {
+		return err
+	}
+
+	commit, err := g.commit(main, conflicts, "wikie", time.Now(), fmt.Sprintf("Keep web edits which conflict with %.7s", main))
+	if err != nil {
+		// Another push; its sync will find the same conflicts.
+		return err
+	}
+	_, err = g.git(nil, nil, "update-ref", gitSynced, commit)
+	return err
+}
+
+func (g *GitSync) git(env []string, stdin []byte, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"--git-dir", g.dir}, args...)...)
+	cmd.Env = append(os.Environ(), env...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// rev is the commit ref points at, or nothing if it does not exist.
+func (g *GitSync) rev(ref string) string {
+	out, err := g.git(nil, nil, "rev-parse", "--quiet", "--verify", ref+"^{commit}")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+// blob is the content of file in commit, if it is there.
+func (g *GitSync) blob(commit, file string) ([]byte, bool) {
+	if len(commit) == 0 {
+		return nil, false
+	}
+	out, err := g.git(nil, nil, "cat-file", "blob", commit+":"+file)
+	if err != nil {
+		return nil, false
+	}
+	return []byte(out), true
+}
+
+// changes are the files added, modified or deleted between two commits.
+func (g *GitSync) changes(from, to string) ([]gitChange, error) {
+	var changes []gitChange
+	if len(from) == 0 {
+		out, err := g.git(nil, nil, "ls-tree", "-r", "-z", "--name-only", to)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range strings.Split(strings.TrimSuffix(out, "\x00"), "\x00") {
+			if len(file) > 0 {
+				changes = append(changes, gitChange{"A", file})
+			}
+		}
+		return changes, nil
+	}
+	out, err := g.git(nil, nil, "diff-tree", "-r", "-z", "--no-renames", "--name-status", from, to)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		changes = append(changes, gitChange{fields[i], fields[i+1]})
+	}
+	return changes, nil
+}
+
+// lastChange is who last changed file between two commits, when, and why.
+func (g *GitSync) lastChange(from, to, file string) (string, time.Time, string) {
+	revs := to
+	if len(from) > 0 {
+		revs = from + ".." + to
+	}
+	out, err := g.git(nil, nil, "log", "-1", "--format=%an%x00%aI%x00%s", revs, "--", file)
+	if err != nil {
+		return "", time.Now(), ""
+	}
+	parts := strings.SplitN(strings.TrimSpace(out), "\x00", 3)
+	if len(parts) != 3 {
+		return "", time.Now(), ""
+	}
+	when, err := time.Parse(time.RFC3339, parts[1])
+	if err != nil {
+		when = time.Now()
+	}
+	return parts[0], when, parts[2]
+}
+
+// commit writes files, or deletes those without content, in a commit on top
+// of parent, and moves the branch to it as long as it still points at parent.
+func (g *GitSync) commit(parent string, files map[string][]byte, author string, when time.Time, message string) (string, error) {
+	f, err := ioutil.TempFile("", "wikie-index")
+	if err != nil {
+		return "", err
+	}
+	index := f.Name()
+	f.Close()
+	// git writes the index itself, and refuses an empty file.
+	os.Remove(index)
+	defer os.Remove(index)
+	env := []string{"GIT_INDEX_FILE=" + index}
+
+	if len(parent) > 0 {
+		_, err := g.git(env, nil, "read-tree", parent)
+		if err != nil {
+			return "", err
+		}
+	}
+	var info bytes.Buffer
+	for file, content := range files {
+		if content == nil {
+			fmt.Fprintf(&info, "0 %s\t%s\x00", gitZero, file)
+			continue
+		}
+		hash, err := g.git(nil, content, "hash-object", "-w", "--stdin")
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&info, "100644 %s\t%s\x00", strings.TrimSpace(hash), file)
+	}
+	_, err = g.git(env, info.Bytes(), "update-index", "-z", "--index-info")
+	if err != nil {
+		return "", err
+	}
+	tree, err := g.git(env, nil, "write-tree")
+	if err != nil {
+		return "", err
+	}
+	tree = strings.TrimSpace(tree)
+
+	args := []string{"commit-tree", tree, "-m", message}
+	old := gitZero
+	if len(parent) > 0 {
+		if parentTree, err := g.git(nil, nil, "rev-parse", parent+"^{tree}"); err == nil && strings.TrimSpace(parentTree) == tree {
+			return parent, nil
+		}
+		args = append(args, "-p", parent)
+		old = parent
+	}
+	commit, err := g.git([]string{
+		"GIT_AUTHOR_NAME=" + author,
+		"GIT_AUTHOR_EMAIL=" + gitEmail(author),
+		"GIT_AUTHOR_DATE=" + when.Format(time.RFC3339),
+		"GIT_COMMITTER_NAME=wikie",
+		"GIT_COMMITTER_EMAIL=wikie@localhost",
+	}, nil, args...)
+	if err != nil {
+		return "", err
+	}
+	commit = strings.TrimSpace(commit)
+	_, err = g.git(nil, nil, "update-ref", gitBranch, commit, old)
+	return commit, err
+}
+
+// page is the page at pagePath as it is in the wiki, if it exists.
+func (g *GitSync) page(ctx context.Context, pagePath string) (Page, bool, error) {
+	result, err := g.client.Get().Index(PageIndex).Id(pagePath).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return Page{}, false, nil
+	} else if err != nil {
+		return Page{}, false, err
+	}
+	if !result.Found {
+		return Page{}, false, nil
+	}
+	page, err := decodePage(pagePath, result.Source)
+	if result.SeqNo != nil && result.PrimaryTerm != nil {
+		page.SeqNo = *result.SeqNo
+		page.PrimaryTerm = *result.PrimaryTerm
+	}
+	return page, err == nil, err
+}
+
+// gitEmail is the email of a user in commits. Users who log in with OAuth2
+// are known by their email already.
+func gitEmail(user string) string {
+	if strings.Contains(user, "@") {
+		return user
+	}
+	return user + "@wikie"
+}
+
+// gitFile is the file the page at pagePath is kept in.
+func gitFile(pagePath string) string {
+	return strings.TrimPrefix(pagePath, "/") + ".md"
+}
+
+// gitPagePath is the path of the page kept in file, if it is one.
+func gitPagePath(file string) (string, bool) {
+	if !strings.HasSuffix(file, ".md") {
+		return "", false
+	}
+	pagePath := "/" + strings.TrimSuffix(file, ".md")
+	resolved, err := ResolveStoragePath(pagePath)
+	return pagePath, err == nil && resolved == pagePath && pagePath != "/"
+}
+
+// encodeGitPage is the markdown file a page is kept in, with its tags and
+// whether it is public as front matter.
+func encodeGitPage(page Page) []byte {
+	var b bytes.Buffer
+	if len(page.Tags) > 0 || page.Public {
+		matter, _ := yaml.Marshal(gitPageMatter{Tags: page.Tags, Public: page.Public})
+		b.WriteString("---\n")
+		b.Write(matter)
+		b.WriteString("---\n\n")
+	}
+	b.WriteString(page.Body)
+	if !strings.HasSuffix(page.Body, "\n") {
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+func decodeGitPage(pagePath string, b []byte, author string, when time.Time) (Page, error) {
+	matter, body, err := splitFrontMatter(b)
+	if err != nil {
+		return Page{}, err
+	}
+	page := Page{Path: pagePath, Body: strings.TrimSuffix(string(body), "\n"), EditedBy: author, LastUpdated: when}
+	applyFrontMatter(&page, matter)
+	return page, nil
+}
+
+// samePage is whether two versions of a page have the same content.
+func samePage(a, b Page) bool {
+	return strings.TrimSpace(a.Body) == strings.TrimSpace(b.Body) &&
+		a.Public == b.Public &&
+		(len(a.Tags) == 0 && len(b.Tags) == 0 || reflect.DeepEqual(a.Tags, b.Tags))
+}
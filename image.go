@@ -0,0 +1,337 @@
+package wikie
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/go-errors/errors"
+	"golang.org/x/image/draw"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// thumbnailsPrefix is where resized copies of images are cached, under the
+// hash of the version they were made from.
+const thumbnailsPrefix = ".thumbnails/"
+
+// ImageWidths are the widths resized variants of images are made at. Requests
+// for other widths are given the next widest so that the cache stays small.
+var ImageWidths = []int{320, 640, 1280, 1920}
+
+// maxImagePixels is the largest image that will be decoded to be resized. A
+// decoded image takes four bytes a pixel, or more while it is being scaled.
+const maxImagePixels = 16000000
+
+// resizing limits how many images are decoded at once, as each can take a
+// lot of memory.
+var resizing = make(chan struct{}, 2)
+
+// ErrNotResizable is returned when an image cannot be resized, in which case
+// the original should be served.
+var ErrNotResizable = errors.New("image cannot be resized")
+
+// Resizable reports whether variants can be made of files of contentType.
+func Resizable(contentType string) bool {
+	switch mediaType(contentType) {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// ImageWidth returns the width of variant to serve for a requested width.
+func ImageWidth(requested int) int {
+	for _, w := range ImageWidths {
+		if requested <= w {
+			return w
+		}
+	}
+	return ImageWidths[len(ImageWidths)-1]
+}
+
+// variantPrefix is where the variants of the version with hash are kept. Files
+// uploaded before versions were kept have no hash, so their variants are kept
+// under the key of the file instead, to be removed along with it. The hidden
+// element after the key keeps them apart from the files under it as a folder.
+func variantPrefix(key, hash string) string {
+	if len(hash) == 0 {
+		return thumbnailsPrefix + "legacy/" + key + "/.variants/"
+	}
+	return thumbnailsPrefix + hash + "/"
+}
+
+// ImageVariant returns a copy of the image at key which is no wider than width
+// and, if strip is set, has had its metadata removed. A width of 0 keeps the
+// original size. hash identifies the version of the image, so that variants
+// are made once per version; it is empty for files which have no versions.
+func ImageVariant(ctx context.Context, blobs BlobStore, key, hash, contentType string, width int, strip bool) (io.ReadSeekCloser, BlobInfo, error) {
+	if !Resizable(contentType) {
+		return nil, BlobInfo{}, ErrNotResizable
+	}
+	variant := variantPrefix(key, hash)
+	if len(hash) == 0 {
+		info, err := blobs.Stat(ctx, key)
+		if err != nil {
+			return nil, BlobInfo{}, err
+		}
+		variant += fmt.Sprintf("%x-%x/", info.ModTime.UnixNano(), info.Size)
+	}
+	variant += strconv.Itoa(width)
+	if strip {
+		variant += "-strip"
+	}
+	if f, info, err := blobs.Open(ctx, variant); err == nil {
+		return f, info, nil
+	} else if err != ErrBlobNotFound {
+		return nil, BlobInfo{}, err
+	}
+
+	select {
+	case resizing <- struct{}{}:
+		defer func() { <-resizing }()
+	case <-ctx.Done():
+		return nil, BlobInfo{}, ctx.Err()
+	}
+	// The variant may have been made while waiting.
+	if f, info, err := blobs.Open(ctx, variant); err == nil {
+		return f, info, nil
+	} else if err != ErrBlobNotFound {
+		return nil, BlobInfo{}, err
+	}
+
+	f, _, err := blobs.Open(ctx, key)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	defer f.Close()
+	// Check the size before reading the whole of an image too large to resize.
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, BlobInfo{}, ErrNotResizable
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+
+	var buf bytes.Buffer
+	err = resizeImage(&buf, b, width, strip)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	err = blobs.Put(ctx, variant, &buf, int64(buf.Len()), contentType)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	return blobs.Open(ctx, variant)
+}
+
+// DeleteImageVariants removes the cached variants of the version with hash.
+func DeleteImageVariants(ctx context.Context, blobs BlobStore, hash string) error {
+	return deleteVariants(ctx, blobs, variantPrefix("", hash))
+}
+
+// deleteLegacyVariants removes the cached variants of the file at key made
+// before it had any versions.
+func deleteLegacyVariants(ctx context.Context, blobs BlobStore, key string) error {
+	return deleteVariants(ctx, blobs, variantPrefix(key, ""))
+}
+
+func deleteVariants(ctx context.Context, blobs BlobStore, prefix string) error {
+	variants, err := blobs.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, variant := range variants {
+		err := blobs.Delete(ctx, variant.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resizeImage writes the image in b to w, scaled down to width. Decoding and
+// encoding again drops any metadata, so an image which does not need to be
+// scaled is only re-encoded when strip is set. Animated GIFs are not resized.
+func resizeImage(w io.Writer, b []byte, width int, strip bool) error {
+	config, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return ErrNotResizable
+	}
+	if (width == 0 || config.Width <= width) && !strip {
+		_, err = w.Write(b)
+		return err
+	}
+
+	if format == "gif" {
+		g, err := gif.DecodeAll(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		if len(g.Image) > 1 {
+			// GIFs carry no EXIF, so there is nothing to strip either.
+			_, err = w.Write(b)
+			return err
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if format == "jpeg" {
+		// The orientation is lost along with the rest of the metadata, so
+		// apply it to the pixels instead.
+		img = orient(img, jpegOrientation(b))
+	}
+
+	bounds := img.Bounds()
+	if width > 0 && bounds.Dx() > width {
+		height := bounds.Dy() * width / bounds.Dx()
+		if height < 1 {
+			height = 1
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+		img = dst
+	}
+
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
+	}
+	return ErrNotResizable
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, or 1 (upright) if it
+// has none.
+func jpegOrientation(b []byte) int {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			return 1
+		}
+		marker := b[i+1]
+		length := int(binary.BigEndian.Uint16(b[i+2:]))
+		if marker == 0xDA || length < 2 || i+2+length > len(b) {
+			// The image data has started without any EXIF.
+			return 1
+		}
+		segment := b[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+func tiffOrientation(t []byte) int {
+	if len(t) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(t[4:]))
+	if ifd+2 > len(t) {
+		return 1
+	}
+	entries := int(order.Uint16(t[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(t) {
+			return 1
+		}
+		if order.Uint16(t[entry:]) == 0x0112 {
+			if o := int(order.Uint16(t[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orient transforms img so that it is upright given its EXIF orientation.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if orientation >= 5 {
+		w, h = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = w-1-y, x
+			case 7:
+				dx, dy = w-1-y, h-1-x
+			case 8:
+				dx, dy = y, h-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// storageImage matches images in rendered pages which are served from storage.
+var storageImage = regexp.MustCompile(`<img src="(/storage/[^"?#]+\.(?i:jpe?g|png|gif))"`)
+
+// srcset adds the resized variants of images in storage to the img elements
+// of rendered html, so that browsers can pick the smallest that will do.
+func srcset(html string) string {
+	return storageImage.ReplaceAllStringFunc(html, func(img string) string {
+		src := storageImage.FindStringSubmatch(img)[1]
+		var set []string
+		for _, w := range ImageWidths {
+			set = append(set, fmt.Sprintf("%s?w=%d %dw", src, w, w))
+		}
+		return fmt.Sprintf(`%s srcset="%s" sizes="(max-width: %dpx) 100vw, %dpx"`, img, strings.Join(set, ", "), ImageWidths[len(ImageWidths)-1], ImageWidths[len(ImageWidths)-1])
+	})
+}
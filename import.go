@@ -0,0 +1,505 @@
+package wikie
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/go-errors/errors"
+	"github.com/olivere/elastic/v7"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errNotImportable is returned for files which are not regular files inside
+// the directory being imported, such as symbolic links out of it.
+var errNotImportable = errors.New("not a regular file inside the imported directory")
+
+var (
+	// markdownLink matches inline links and images in markdown.
+	markdownLink = regexp.MustCompile(`(!?\[[^\]]*\]\()(<?)([^)\s>]+)(>?(?:\s+"[^"]*")?\))`)
+	// markdownReference matches link reference definitions in markdown.
+	markdownReference = regexp.MustCompile(`(?m)^( {0,3}\[[^\]]+\]:\s+)(<?)(\S+?)(>?(?:\s+.*)?)$`)
+	// frontMatterEnd matches the line closing front matter.
+	frontMatterEnd = regexp.MustCompile(`(?m)^(?:---|\.\.\.)\r?$`)
+	// unsafePageChars are the characters replaced when a file name becomes a page name.
+	unsafePageChars = regexp.MustCompile(`[\s?#%]+`)
+)
+
+// frontMatterLayouts are the date formats accepted in front matter.
+var frontMatterLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// ImportOptions controls how documents are imported.
+type ImportOptions struct {
+	// Prefix is the path pages are imported under, e.g. /docs.
+	Prefix string
+	// User is who the pages are imported by when their history does not say.
+	User string
+	// Overwrite replaces pages which already exist rather than skipping them.
+	Overwrite bool
+	// DryRun reports what would be imported without changing anything.
+	DryRun bool
+}
+
+// ImportConflict is a document that was not imported.
+type ImportConflict struct {
+	Path   string
+	Source string
+	Reason string
+}
+
+// ImportReport is what an import did, or would do on a dry run.
+type ImportReport struct {
+	Created   []string
+	Replaced  []string
+	Files     []string
+	Conflicts []ImportConflict
+}
+
+func (r *ImportReport) conflict(w io.Writer, pagePath, source, reason string) {
+	r.Conflicts = append(r.Conflicts, ImportConflict{Path: pagePath, Source: source, Reason: reason})
+	fmt.Fprintf(w, "conflict: %s (from %s): %s\n", pagePath, source, reason)
+}
+
+type frontMatter struct {
+	Title   string      `yaml:"title"`
+	Tags    interface{} `yaml:"tags"`
+	Public  bool        `yaml:"public"`
+	Author  string      `yaml:"author"`
+	Date    string      `yaml:"date"`
+	Updated string      `yaml:"updated"`
+}
+
+type markdownDocument struct {
+	source string
+	page   Page
+}
+
+// ImportMarkdown creates a page for every markdown file in the directory dir,
+// at the same path under the prefix. Front matter sets the title, tags,
+// author and date of a page, relative links between the files become links
+// between the pages, and images and other files they link to are uploaded to
+// the page. When dir is a git checkout, pages are attributed to whoever last
+// changed them. Progress is written to w.
+func ImportMarkdown(ctx context.Context, client *elastic.Client, db *bolt.DB, blobs BlobStore, dir string, opts ImportOptions, w io.Writer) (ImportReport, error) {
+	var report ImportReport
+	prefix := "/" + strings.Trim(opts.Prefix, "/")
+	git := isGitCheckout(dir)
+
+	// Find every document first, so that links between them can be resolved.
+	docs := make(map[string]*markdownDocument)
+	var sources []string
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && name != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || !isMarkdown(name) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		docs[rel] = &markdownDocument{source: rel, page: Page{Path: markdownPagePath(prefix, rel), LastUpdated: info.ModTime(), EditedBy: opts.User}}
+		sources = append(sources, rel)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	sort.Strings(sources)
+
+	paths := make(map[string]string)
+	for _, source := range sources {
+		doc := docs[source]
+		if other, ok := paths[doc.page.Path]; ok {
+			report.conflict(w, doc.page.Path, source, "also imported from "+other)
+			delete(docs, source)
+			continue
+		}
+		paths[doc.page.Path] = source
+	}
+
+	for _, source := range sources {
+		doc, ok := docs[source]
+		if !ok {
+			continue
+		}
+		pagePath := doc.page.Path
+
+		exists, err := pageExists(ctx, client, pagePath)
+		if err != nil {
+			return report, err
+		}
+		if exists && !opts.Overwrite {
+			report.conflict(w, pagePath, source, "page already exists")
+			continue
+		}
+
+		name, err := importSourcePath(dir, filepath.Join(dir, filepath.FromSlash(source)))
+		if err == errNotImportable {
+			report.conflict(w, pagePath, source, err.Error())
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return report, err
+		}
+		matter, body, err := splitFrontMatter(b)
+		if err != nil {
+			report.conflict(w, pagePath, source, "invalid front matter: "+err.Error())
+			continue
+		}
+		page := doc.page
+		if git {
+			if author, updated, ok := gitLastChange(dir, source); ok {
+				page.EditedBy, page.LastUpdated = author, updated
+			}
+		}
+		files := make(map[string]string)
+		body = rewriteMarkdownLinks(body, func(target string) string {
+			u, err := url.Parse(target)
+			if err != nil || len(u.Scheme) > 0 || len(u.Host) > 0 || len(u.Path) == 0 || strings.HasPrefix(u.Path, "/") {
+				return target
+			}
+			rel := path.Join(path.Dir(source), u.Path)
+			if rel == ".." || strings.HasPrefix(rel, "../") {
+				return target
+			}
+			if linked, ok := docs[rel]; ok {
+				u.Path = "/w" + linked.page.Path
+				return u.String()
+			}
+			for _, index := range []string{"README.md", "index.md"} {
+				if linked, ok := docs[path.Join(rel, index)]; ok {
+					u.Path = "/w" + linked.page.Path
+					return u.String()
+				}
+			}
+			if _, err := importSourcePath(dir, filepath.Join(dir, filepath.FromSlash(rel))); err != nil {
+				return target
+			}
+			filePath, ok := files[rel]
+			if !ok {
+				filePath = importFilePath(pagePath, rel, files)
+				files[rel] = filePath
+			}
+			u.Path = "/storage" + filePath
+			return u.String()
+		})
+		page.Body = string(body)
+		applyFrontMatter(&page, matter)
+
+		var uploads []string
+		for rel := range files {
+			uploads = append(uploads, rel)
+		}
+		sort.Strings(uploads)
+		for _, rel := range uploads {
+			filePath := files[rel]
+			report.Files = append(report.Files, filePath)
+			if opts.DryRun {
+				fmt.Fprintf(w, "would upload %s to %s\n", rel, filePath)
+				continue
+			}
+			err := importFile(ctx, client, db, blobs, dir, filepath.Join(dir, filepath.FromSlash(rel)), filePath, page.EditedBy)
+			if err == errNotImportable {
+				fmt.Fprintf(w, "skipped %s: %v\n", rel, err)
+				continue
+			} else if err != nil {
+				return report, err
+			}
+			fmt.Fprintf(w, "uploaded %s to %s\n", rel, filePath)
+		}
+
+		verb := "created"
+		if exists {
+			verb = "replaced"
+			report.Replaced = append(report.Replaced, pagePath)
+		} else {
+			report.Created = append(report.Created, pagePath)
+		}
+		if opts.DryRun {
+			fmt.Fprintf(w, "would have %s %s from %s\n", verb, pagePath, source)
+			continue
+		}
+		err = NewPage(client, pagePath, page)
+		if err != nil {
+			return report, err
+		}
+		fmt.Fprintf(w, "%s %s from %s\n", verb, pagePath, source)
+	}
+
+	if !opts.DryRun {
+		_, err = client.Refresh(PageIndex).Do(ctx)
+		if err != nil {
+			return report, err
+		}
+	}
+	fmt.Fprintf(w, "%d pages created, %d replaced, %d files uploaded, %d conflicts\n", len(report.Created), len(report.Replaced), len(report.Files), len(report.Conflicts))
+	return report, nil
+}
+
+// CloneGit clones the git repository at url into a new temporary directory,
+// which the caller should remove. The whole history is fetched so that pages
+// can be attributed to their authors.
+func CloneGit(url string) (string, error) {
+	dir, err := ioutil.TempDir("", "wikie-import")
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.Command("git", "clone", "--quiet", "--", url, dir).CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("could not clone %s: %s", url, strings.TrimSpace(string(out)))
+	}
+	return dir, nil
+}
+
+func isMarkdown(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+// markdownPagePath is the path of the page imported from the markdown file at
+// rel. A README or index file becomes the page of its directory.
+func markdownPagePath(prefix, rel string) string {
+	rel = strings.TrimSuffix(rel, path.Ext(rel))
+	switch strings.ToLower(path.Base(rel)) {
+	case "readme", "index":
+		rel = path.Dir(rel)
+	}
+	var elems []string
+	for _, elem := range strings.Split(rel, "/") {
+		if elem == "." {
+			continue
+		}
+		elems = append(elems, strings.Trim(unsafePageChars.ReplaceAllString(elem, "-"), "-"))
+	}
+	p := path.Join(prefix, strings.Join(elems, "/"))
+	if p == "/" {
+		return "/home"
+	}
+	return p
+}
+
+// importFilePath is where the file at rel is uploaded for the page at
+// pagePath, given a new name if another file already has its name.
+func importFilePath(pagePath, rel string, files map[string]string) string {
+	name := unsafePageChars.ReplaceAllString(strings.TrimLeft(path.Base(rel), "."), "-")
+	taken := make(map[string]bool)
+	for _, filePath := range files {
+		taken[filePath] = true
+	}
+	filePath := path.Join(pagePath, name)
+	ext := path.Ext(name)
+	for i := 2; taken[filePath]; i++ {
+		filePath = path.Join(pagePath, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+	return filePath
+}
+
+// importSourcePath returns where the file name, in the directory dir being
+// imported, really is. It must be a regular file rather than a link, and must
+// still be inside dir once any links in its path are followed.
+func importSourcePath(dir, name string) (string, error) {
+	info, err := os.Lstat(name)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", errNotImportable
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", errNotImportable
+	}
+	return resolved, nil
+}
+
+// importFile uploads the file name, in the directory dir being imported, to
+// filePath.
+func importFile(ctx context.Context, client *elastic.Client, db *bolt.DB, blobs BlobStore, dir, name, filePath, user string) error {
+	resolved, err := importSourcePath(dir, name)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(resolved)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// It could have been replaced since it was checked.
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if !info.Mode().IsRegular() {
+		return errNotImportable
+	}
+	contentType, err := SniffContentType(name, f)
+	if err != nil {
+		return err
+	}
+	_, err = StoreFile(ctx, db, blobs, filePath, f, contentType, user, nil)
+	if err != nil {
+		return err
+	}
+
+	// Make the file searchable, as if it had been uploaded.
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	text, err := ExtractText(filePath, f)
+	if err != nil {
+		return nil
+	}
+	return IndexAttachment(client, Attachment{
+		Path:        filePath,
+		Page:        path.Dir(filePath),
+		Name:        path.Base(filePath),
+		Body:        text,
+		LastUpdated: time.Now(),
+		EditedBy:    user,
+	})
+}
+
+// rewriteMarkdownLinks replaces the target of every link, image and link
+// reference in body with what rewrite returns for it. Code is left alone.
+func rewriteMarkdownLinks(body []byte, rewrite func(string) string) []byte {
+	var out bytes.Buffer
+	fenced := false
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		trimmed := bytes.TrimSpace(line)
+		if bytes.HasPrefix(trimmed, []byte("```")) || bytes.HasPrefix(trimmed, []byte("~~~")) {
+			fenced = !fenced
+		}
+		if fenced || bytes.HasPrefix(line, []byte("    ")) || bytes.HasPrefix(line, []byte("\t")) {
+			out.Write(line)
+			continue
+		}
+		line = markdownLink.ReplaceAllFunc(line, func(m []byte) []byte {
+			g := markdownLink.FindSubmatch(m)
+			return []byte(string(g[1]) + string(g[2]) + rewrite(string(g[3])) + string(g[4]))
+		})
+		line = markdownReference.ReplaceAllFunc(line, func(m []byte) []byte {
+			g := markdownReference.FindSubmatch(m)
+			return []byte(string(g[1]) + string(g[2]) + rewrite(string(g[3])) + string(g[4]))
+		})
+		out.Write(line)
+	}
+	return out.Bytes()
+}
+
+// splitFrontMatter separates the YAML front matter, between --- lines at the
+// start of a document, from its body.
+func splitFrontMatter(b []byte) (frontMatter, []byte, error) {
+	var matter frontMatter
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	if !bytes.HasPrefix(b, []byte("---\n")) && !bytes.HasPrefix(b, []byte("---\r\n")) {
+		return matter, b, nil
+	}
+	rest := b[bytes.IndexByte(b, '\n')+1:]
+	end := frontMatterEnd.FindIndex(rest)
+	if end == nil {
+		return matter, b, nil
+	}
+	err := yaml.Unmarshal(rest[:end[0]], &matter)
+	if err != nil {
+		return matter, nil, err
+	}
+	body := rest[end[1]:]
+	return matter, bytes.TrimLeft(body, "\r\n"), nil
+}
+
+func applyFrontMatter(page *Page, matter frontMatter) {
+	if len(matter.Author) > 0 {
+		page.EditedBy = matter.Author
+	}
+	for _, s := range []string{matter.Date, matter.Updated} {
+		for _, layout := range frontMatterLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				page.LastUpdated = t
+				break
+			}
+		}
+	}
+	page.Public = matter.Public
+	switch tags := matter.Tags.(type) {
+	case string:
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); len(tag) > 0 {
+				page.Tags = append(page.Tags, tag)
+			}
+		}
+	case []interface{}:
+		for _, tag := range tags {
+			page.Tags = append(page.Tags, fmt.Sprint(tag))
+		}
+	}
+	// The title of a page is its first heading, so give it one.
+	if len(matter.Title) > 0 && page.title() == path.Base(page.Path) {
+		page.Body = "# " + matter.Title + "\n\n" + page.Body
+	}
+}
+
+func pageExists(ctx context.Context, client *elastic.Client, pagePath string) (bool, error) {
+	result, err := client.Get().Index(PageIndex).Id(pagePath).FetchSource(false).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return result.Found, nil
+}
+
+func isGitCheckout(dir string) bool {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "--is-inside-work-tree").Output()
+	return err == nil && strings.TrimSpace(string(out)) == "true"
+}
+
+// gitLastChange is who last changed the file at rel in the checkout at dir, and when.
+func gitLastChange(dir, rel string) (string, time.Time, bool) {
+	out, err := exec.Command("git", "-C", dir, "log", "-1", "--format=%an%x00%aI", "--", rel).Output()
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(out)), "\x00", 2)
+	if len(parts) != 2 {
+		return "", time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, parts[1])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return parts[0], t, true
+}
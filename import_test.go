@@ -0,0 +1,151 @@
+package wikie
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMarkdownPagePath(t *testing.T) {
+	for _, test := range []struct {
+		prefix, rel, want string
+	}{
+		{"/", "README.md", "/home"},
+		{"/", "index.markdown", "/home"},
+		{"/docs", "README.md", "/docs"},
+		{"/docs", "guide/setup.md", "/docs/guide/setup"},
+		{"/docs", "guide/Readme.md", "/docs/guide"},
+		{"/docs", "release notes/what's new?.md", "/docs/release-notes/what's-new"},
+		{"/", "./a/b.md", "/a/b"},
+	} {
+		if got := markdownPagePath(test.prefix, test.rel); got != test.want {
+			t.Errorf("markdownPagePath(%q, %q) = %q, want %q", test.prefix, test.rel, got, test.want)
+		}
+	}
+}
+
+func TestImportFilePath(t *testing.T) {
+	files := map[string]string{
+		"img/diagram.png":  "/docs/diagram.png",
+		"old/diagram.png":  "/docs/diagram-2.png",
+		"notes/report.pdf": "/docs/report.pdf",
+	}
+	for _, test := range []struct {
+		rel, want string
+	}{
+		{"new/diagram.png", "/docs/diagram-3.png"},
+		{"a/report.pdf", "/docs/report-2.pdf"},
+		{"a/photo.jpg", "/docs/photo.jpg"},
+		{"a/.hidden file", "/docs/hidden-file"},
+	} {
+		if got := importFilePath("/docs", test.rel, files); got != test.want {
+			t.Errorf("importFilePath(%q) = %q, want %q", test.rel, got, test.want)
+		}
+	}
+}
+
+func TestRewriteMarkdownLinks(t *testing.T) {
+	rewrite := func(target string) string {
+		return strings.ToUpper(target)
+	}
+	for _, test := range []struct {
+		body, want string
+	}{
+		{"see [setup](setup.md) and ![](img/a.png)\n", "see [setup](SETUP.MD) and ![](IMG/A.PNG)\n"},
+		{`[title](a.md "The title")`, `[title](A.MD "The title")`},
+		{"[spaced](<a b.md>)", "[spaced](<a b.md>)"},
+		{"[ref]: docs/a.md \"Title\"\n", "[ref]: DOCS/A.MD \"Title\"\n"},
+		{"```\n[code](a.md)\n```\n[text](a.md)\n", "```\n[code](a.md)\n```\n[text](A.MD)\n"},
+		{"    [indented](a.md)\n", "    [indented](a.md)\n"},
+	} {
+		if got := string(rewriteMarkdownLinks([]byte(test.body), rewrite)); got != test.want {
+			t.Errorf("rewriteMarkdownLinks(%q) = %q, want %q", test.body, got, test.want)
+		}
+	}
+}
+
+func TestFrontMatter(t *testing.T) {
+	for _, test := range []struct {
+		doc  string
+		want Page
+	}{
+		{
+			"no front matter\n",
+			Page{Path: "/a", Body: "no front matter\n"},
+		},
+		{
+			"---\ntitle: Setup\nauthor: alice\ndate: 2020-01-02\ntags: [ops, db]\npublic: true\n---\n\nbody\n",
+			Page{Path: "/a", Body: "# Setup\n\nbody\n", EditedBy: "alice", LastUpdated: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), Tags: []string{"ops", "db"}, Public: true},
+		},
+		{
+			"\xef\xbb\xbf---\r\ntitle: Setup\r\ntags: ops, db\r\n...\r\n# Heading\n",
+			Page{Path: "/a", Body: "# Heading\n", Tags: []string{"ops", "db"}},
+		},
+		{
+			"---\nnot closed\n",
+			Page{Path: "/a", Body: "---\nnot closed\n"},
+		},
+	} {
+		matter, body, err := splitFrontMatter([]byte(test.doc))
+		if err != nil {
+			t.Errorf("splitFrontMatter(%q): %v", test.doc, err)
+			continue
+		}
+		page := Page{Path: "/a", Body: string(body)}
+		applyFrontMatter(&page, matter)
+		if !reflect.DeepEqual(page, test.want) {
+			t.Errorf("front matter of %q gave %+v, want %+v", test.doc, page, test.want)
+		}
+	}
+	if _, _, err := splitFrontMatter([]byte("---\ntags: [\n---\nbody")); err == nil {
+		t.Errorf("splitFrontMatter accepted invalid YAML")
+	}
+}
+
+func TestImportSourcePath(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	for _, name := range []string{filepath.Join(dir, "a.md"), filepath.Join(outside, "secret")} {
+		err := ioutil.WriteFile(name, []byte("x"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Mkdir(filepath.Join(dir, "sub"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range [][2]string{
+		{filepath.Join(outside, "secret"), filepath.Join(dir, "secret.md")},
+		{outside, filepath.Join(dir, "out")},
+		{filepath.Join(dir, "sub"), filepath.Join(dir, "in")},
+	} {
+		err := os.Symlink(link[0], link[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "sub", "b.md"), []byte("x"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		ok   bool
+	}{
+		{"a.md", true},
+		{"in/b.md", true},
+		{"secret.md", false},
+		{"out/secret", false},
+		{"sub", false},
+	} {
+		_, err := importSourcePath(dir, filepath.Join(dir, test.name))
+		if (err == nil) != test.ok {
+			t.Errorf("importSourcePath(%q) = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package wikie
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/olivere/elastic/v7"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// PageIndex is the alias of the index that pages are stored in.
+	PageIndex = "wikie"
+	// AttachmentIndex is the alias of the index that attachment text is stored in.
+	AttachmentIndex = "wikie-attachments"
+)
+
+// reindexBatchSize is the number of documents copied at a time by Reindex.
+const reindexBatchSize = 500
+
+// dateFormat is the format of date fields in the index.
+const dateFormat = "strict_date_optional_time||epoch_millis"
+
+// indexBody returns the settings and mappings used to create a new version of
+// the index behind alias. The body of pages and attachments is analysed with
+// the standard analyzer, and additionally with each of the configured language
+// analyzers as body.<language>.
+func indexBody(alias string, config ElasticsearchConfig) map[string]interface{} {
+	body := map[string]interface{}{"type": "text"}
+	if len(config.Languages) > 0 {
+		fields := make(map[string]interface{})
+		for _, language := range config.Languages {
+			fields[language] = map[string]interface{}{"type": "text", "analyzer": language}
+		}
+		body["fields"] = fields
+	}
+
+	keyword := map[string]interface{}{"type": "keyword", "ignore_above": 256}
+	path := map[string]interface{}{
+		"type": "keyword",
+		"fields": map[string]interface{}{
+			"text":    map[string]interface{}{"type": "text"},
+			"suggest": map[string]interface{}{"type": "text", "analyzer": "autocomplete", "search_analyzer": "standard"},
+		},
+	}
+	updated := map[string]interface{}{"type": "date", "format": dateFormat}
+
+	var properties map[string]interface{}
+	switch alias {
+	case PageIndex:
+		properties = map[string]interface{}{
+			"path": path,
+			"title": map[string]interface{}{
+				"type": "text",
+				"fields": map[string]interface{}{
+					"suggest": map[string]interface{}{"type": "text", "analyzer": "autocomplete", "search_analyzer": "standard"},
+				},
+			},
+			"body":    body,
+			"updated": updated,
+			"edited":  keyword,
+			"public":  map[string]interface{}{"type": "boolean"},
+			"tags":    keyword,
+		}
+	case AttachmentIndex:
+		properties = map[string]interface{}{
+			"path":    path,
+			"page":    keyword,
+			"name":    map[string]interface{}{"type": "text"},
+			"body":    body,
+			"updated": updated,
+			"edited":  keyword,
+		}
+	}
+
+	return map[string]interface{}{
+		"settings": map[string]interface{}{
+			"analysis": map[string]interface{}{
+				"filter": map[string]interface{}{
+					"autocomplete": map[string]interface{}{"type": "edge_ngram", "min_gram": 1, "max_gram": 20},
+				},
+				"analyzer": map[string]interface{}{
+					"autocomplete": map[string]interface{}{"type": "custom", "tokenizer": "standard", "filter": []string{"lowercase", "autocomplete"}},
+				},
+			},
+		},
+		"mappings": map[string]interface{}{
+			"dynamic":    false,
+			"properties": properties,
+		},
+	}
+}
+
+// versionedIndex returns a new name for the index behind alias.
+func versionedIndex(alias string) string {
+	return alias + "-" + time.Now().UTC().Format("20060102150405")
+}
+
+// isIndexOf reports whether index is one of the versioned indices behind alias.
+func isIndexOf(index, alias string) bool {
+	if index == alias {
+		return true
+	}
+	suffix := strings.TrimPrefix(index, alias+"-")
+	if suffix == index || len(suffix) != len("20060102150405") {
+		return false
+	}
+	_, err := time.Parse("20060102150405", suffix)
+	return err == nil
+}
+
+// aliasedIndices returns the indices behind alias, and whether alias is instead
+// the name of an index created before indices were versioned.
+func aliasedIndices(client *elastic.Client, alias string) ([]string, bool, error) {
+	aliases, err := client.Aliases().Do(context.Background())
+	if err != nil {
+		return nil, false, err
+	}
+	if indices := aliases.IndicesByAlias(alias); len(indices) > 0 {
+		return indices, false, nil
+	}
+	exists, err := client.IndexExists(alias).Do(context.Background())
+	if err != nil {
+		return nil, false, err
+	}
+	if exists {
+		return []string{alias}, true, nil
+	}
+	return nil, false, nil
+}
+
+// CreateIndices creates a versioned index behind each of the page and
+// attachment aliases if they do not exist yet. Indices created by earlier
+// versions of wikie, without an alias or with an older mapping, are migrated
+// with Reindex, and its progress written to w.
+func CreateIndices(client *elastic.Client, config ElasticsearchConfig, w io.Writer) error {
+	for _, alias := range []string{PageIndex, AttachmentIndex} {
+		indices, legacy, err := aliasedIndices(client, alias)
+		if err != nil {
+			return err
+		}
+		reason := "was created without a mapping by an earlier version of wikie"
+		if !legacy && len(indices) > 0 {
+			reason, err = outdatedMapping(client, alias)
+			if err != nil {
+				return err
+			}
+		}
+		if len(indices) > 0 && len(reason) > 0 {
+			fmt.Fprintf(w, "index %s %s, migrating it\n", alias, reason)
+			err = reindex(client, config, alias, w)
+			if err != nil {
+				return err
+			}
+			continue
+		} else if len(indices) > 0 {
+			continue
+		}
+
+		body := indexBody(alias, config)
+		body["aliases"] = map[string]interface{}{alias: map[string]interface{}{}}
+		_, err = client.CreateIndex(versionedIndex(alias)).BodyJson(body).Do(context.Background())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outdatedMapping says why the mapping of the index behind alias is too old
+// for this version of wikie, or is empty when it is not.
+func outdatedMapping(client *elastic.Client, alias string) (string, error) {
+	mappings, err := client.GetMapping().Index(alias).Do(context.Background())
+	if err != nil {
+		return "", err
+	}
+	for _, mapping := range mappings {
+		var index struct {
+			Mappings struct {
+				Properties map[string]struct {
+					Type   string                     `json:"type"`
+					Fields map[string]json.RawMessage `json:"fields"`
+				} `json:"properties"`
+			} `json:"mappings"`
+		}
+		b, err := json.Marshal(mapping)
+		if err != nil {
+			return "", err
+		}
+		err = json.Unmarshal(b, &index)
+		if err != nil {
+			return "", err
+		}
+		// Searching by date needs updated to be a date rather than text.
+		if index.Mappings.Properties["updated"].Type != "date" {
+			return "does not map updated as a date", nil
+		}
+		// Suggestions search the suggest fields, which are otherwise empty.
+		suggested := []string{"path"}
+		if alias == PageIndex {
+			suggested = append(suggested, "title")
+		}
+		for _, field := range suggested {
+			if _, ok := index.Mappings.Properties[field].Fields["suggest"]; !ok {
+				return "has no " + field + ".suggest field for suggestions", nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// Reindex builds a new version of the page and attachment indices using the
+// current mappings, copies every document into them, and then swaps the alias
+// over so that readers are never without an index. Progress is written to w.
+func Reindex(client *elastic.Client, config ElasticsearchConfig, w io.Writer) error {
+	for _, alias := range []string{PageIndex, AttachmentIndex} {
+		err := reindex(client, config, alias, w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindex builds a new version of the index behind alias. Documents are
+// copied while the old index is still written to; then writes to it are
+// blocked while what changed in the meantime is copied and the alias is
+// swapped, so that no change is lost.
+func reindex(client *elastic.Client, config ElasticsearchConfig, alias string, w io.Writer) error {
+	indices, legacy, err := aliasedIndices(client, alias)
+	if err != nil {
+		return err
+	}
+
+	index := versionedIndex(alias)
+	_, err = client.CreateIndex(index).BodyJson(indexBody(alias, config)).Do(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "created %s\n", index)
+
+	copied := make(map[string]int64)
+	for _, old := range indices {
+		n, err := copyIndex(client, old, index, alias, copied, nil, nil)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "copied %d documents from %s to %s\n", n, old, index)
+	}
+	if len(indices) == 0 {
+		_, err = client.Alias().Add(index, alias).Do(context.Background())
+		return err
+	}
+
+	err = blockWrites(client, indices, true)
+	if err != nil {
+		return err
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			blockWrites(client, indices, false)
+		}
+	}()
+
+	// Scrolls only see what has been refreshed.
+	_, err = client.Refresh(indices...).Do(context.Background())
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]int64, len(copied))
+	for id, version := range copied {
+		seen[id] = version
+	}
+	present := make(map[string]bool, len(copied))
+	for _, old := range indices {
+		n, err := copyIndex(client, old, index, alias, copied, seen, present)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			fmt.Fprintf(w, "copied %d documents changed during reindexing\n", n)
+		}
+	}
+	bulk := client.Bulk()
+	for id := range copied {
+		if !present[id] {
+			bulk.Add(elastic.NewBulkDeleteRequest().Index(index).Id(id))
+		}
+	}
+	if bulk.NumberOfActions() > 0 {
+		n := bulk.NumberOfActions()
+		_, err = bulk.Do(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "deleted %d documents removed during reindexing\n", n)
+	}
+
+	// The alias moves in one request, replacing an index of the same name
+	// if it was created before indices were versioned.
+	swap := client.Alias().Add(index, alias)
+	for _, old := range indices {
+		if legacy {
+			swap.Action(elastic.NewAliasRemoveIndexAction(old))
+		} else {
+			swap.Remove(old, alias)
+		}
+	}
+	_, err = swap.Do(context.Background())
+	if err != nil {
+		return err
+	}
+	swapped = true
+	if !legacy {
+		for _, old := range indices {
+			_, err = client.DeleteIndex(old).Do(context.Background())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Fprintf(w, "%s now points to %s\n", alias, index)
+	return nil
+}
+
+// blockWrites blocks, or unblocks, writes to the indices.
+func blockWrites(client *elastic.Client, indices []string, block bool) error {
+	_, err := client.IndexPutSettings(indices...).BodyJson(map[string]interface{}{"index.blocks.write": block}).Do(context.Background())
+	return err
+}
+
+// copyIndex copies the documents of index from into index to, converting them
+// to the current document format. The version of each copied document is
+// recorded in copied; when seen is not nil, documents whose version is already
+// in seen are skipped. When present is not nil, the id of every document in
+// from is recorded in it.
+func copyIndex(client *elastic.Client, from, to, alias string, copied, seen map[string]int64, present map[string]bool) (int, error) {
+	n := 0
+	scroll := client.Scroll(from).Size(reindexBatchSize).Version(true)
+	defer scroll.Clear(context.Background())
+	for {
+		result, err := scroll.Do(context.Background())
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+
+		bulk := client.Bulk()
+		for _, hit := range result.Hits.Hits {
+			var version int64
+			if hit.Version != nil {
+				version = *hit.Version
+			}
+			if hit.Source == nil {
+				continue
+			}
+			if present != nil {
+				present[hit.Id] = true
+			}
+			if v, ok := seen[hit.Id]; ok && v == version {
+				continue
+			}
+			doc, err := migrateDocument(alias, hit.Id, hit.Source)
+			if err != nil {
+				return n, err
+			}
+			bulk.Add(elastic.NewBulkIndexRequest().Index(to).Id(hit.Id).Doc(doc))
+			copied[hit.Id] = version
+		}
+		if bulk.NumberOfActions() == 0 {
+			continue
+		}
+
+		resp, err := bulk.Do(context.Background())
+		if err != nil {
+			return n, err
+		}
+		if resp.Errors {
+			for _, failed := range resp.Failed() {
+				if failed.Error != nil {
+					return n, fmt.Errorf("could not copy %s: %s", failed.Id, failed.Error.Reason)
+				}
+			}
+		}
+		n += len(resp.Succeeded())
+	}
+}
+
+// migrateDocument converts a document written by an earlier version of wikie
+// into the current format: timestamps become RFC 3339, fields which are now
+// derived when a page is read are dropped, and missing paths and titles are
+// filled in from the document id.
+func migrateDocument(alias, id string, source []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	err := json.Unmarshal(source, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if updated, ok := doc["updated"].(string); ok {
+		if t, err := ParseTimestamp(updated); err == nil {
+			doc["updated"] = t.Format(time.RFC3339)
+		}
+	}
+	if p, ok := doc["path"].(string); !ok || len(p) == 0 {
+		doc["path"] = id
+	}
+
+	if alias == PageIndex {
+		delete(doc, "Files")
+		delete(doc, "relationships")
+		if t, ok := doc["title"].(string); !ok || len(t) == 0 {
+			body, _ := doc["body"].(string)
+			doc["title"] = Page{Path: id, Body: body}.title()
+		}
+	}
+	return doc, nil
+}
@@ -0,0 +1,725 @@
+package wikie
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/olivere/elastic/v7"
+	"html"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MediaWiki namespaces which are not imported: talk pages are the odd ones.
+const (
+	mwNamespaceFile      = 6
+	mwNamespaceMediaWiki = 8
+	mwNamespaceTemplate  = 10
+	mwNamespaceCategory  = 14
+	mwNamespaceModule    = 828
+)
+
+var (
+	mwHeading    = regexp.MustCompile(`^(={1,6})\s*(.+?)\s*=+\s*$`)
+	mwList       = regexp.MustCompile(`^([*#:;]+)\s*(.*)$`)
+	mwRule       = regexp.MustCompile(`^-{4,}\s*$`)
+	mwExternal   = regexp.MustCompile(`\[((?:https?|ftp)://[^\s\]]+|mailto:[^\s\]]+)(?:\s+([^\]]*))?\]`)
+	mwBoldItalic = regexp.MustCompile(`'''''(.+?)'''''`)
+	mwBold       = regexp.MustCompile(`'''(.+?)'''`)
+	mwItalic     = regexp.MustCompile(`''(.+?)''`)
+	mwComment    = regexp.MustCompile(`(?s)<!--.*?-->`)
+	mwVerbatim   = regexp.MustCompile(`(?s)<(nowiki|pre|syntaxhighlight|source)(\s[^>]*)?>(.*?)</(?:nowiki|pre|syntaxhighlight|source)>`)
+	mwLang       = regexp.MustCompile(`lang="?([\w+-]+)`)
+	mwRef        = regexp.MustCompile(`(?s)<ref(?:\s[^>/]*)?>(.*?)</ref>`)
+	mwEmptyTag   = regexp.MustCompile(`<(?:ref|references|nowiki)(?:\s[^>]*)?/>`)
+	mwMagicWord  = regexp.MustCompile(`__[A-Z]+__`)
+	// markdownInlineLink matches the links the conversion has made.
+	markdownInlineLink = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	mwPlaceholder      = regexp.MustCompile("\x00(\\d+)\x00")
+	// mwCategoryLink is where a category link was, and the spaces after it.
+	mwCategoryLink = regexp.MustCompile("\x01[ \t]*")
+	mwBlankLines   = regexp.MustCompile(`\n{3,}`)
+	mwImageOption  = regexp.MustCompile(`^(?:thumb|thumbnail|frame|frameless|border|left|right|center|centre|none|baseline|middle|top|bottom|upright(?:=.*)?|\d*x?\d+px|(?:link|page|class|lang)=.*)$`)
+	// mwTitleChars are the characters of a title replaced when it becomes a path.
+	mwTitleChars = regexp.MustCompile(`[\s?#%()\[\]{}|<>"]+`)
+)
+
+// MediaWikiOptions controls how a MediaWiki export is imported.
+type MediaWikiOptions struct {
+	ImportOptions
+	// Namespaces maps the names of MediaWiki namespaces to the paths their
+	// pages are imported under. Unmapped namespaces go under the prefix, in
+	// a namespace named after them.
+	Namespaces map[string]string
+	// Files is the images directory of the MediaWiki, from which the files
+	// pages use are uploaded.
+	Files string
+}
+
+type mwSiteInfo struct {
+	Namespaces []struct {
+		Key  int    `xml:"key,attr"`
+		Name string `xml:",chardata"`
+	} `xml:"namespaces>namespace"`
+}
+
+type mwPage struct {
+	Title    string `xml:"title"`
+	NS       int    `xml:"ns"`
+	Redirect *struct {
+		Title string `xml:"title,attr"`
+	} `xml:"redirect"`
+	Revisions []mwRevision `xml:"revision"`
+}
+
+type mwRevision struct {
+	Timestamp   string `xml:"timestamp"`
+	Contributor struct {
+		Username string `xml:"username"`
+		IP       string `xml:"ip"`
+	} `xml:"contributor"`
+	Comment string `xml:"comment"`
+	Text    string `xml:"text"`
+}
+
+func (r mwRevision) author() string {
+	if len(r.Contributor.Username) > 0 {
+		return r.Contributor.Username
+	}
+	return r.Contributor.IP
+}
+
+// mediaWiki maps the titles of a MediaWiki onto wikie paths.
+type mediaWiki struct {
+	prefix     string
+	namespaces map[string]int
+	paths      map[int]string
+	files      map[string]string
+	// filesDir is the images directory files are uploaded from.
+	filesDir string
+}
+
+// ImportMediaWiki creates a page for every article in a MediaWiki XML export,
+// converting the wikitext of each revision to markdown and keeping them as
+// the history of the page. Categories become tags, and images are uploaded
+// from the images directory when one is given. Talk pages, templates and the
+// like are not imported. Progress is written to w.
+func ImportMediaWiki(ctx context.Context, client *elastic.Client, db *bolt.DB, blobs BlobStore, r io.Reader, opts MediaWikiOptions, w io.Writer) (ImportReport, error) {
+	var report ImportReport
+	wiki := newMediaWiki(opts.Prefix)
+	if len(opts.Files) > 0 {
+		files, err := mediaWikiFiles(opts.Files)
+		if err != nil {
+			return report, err
+		}
+		wiki.files, wiki.filesDir = files, opts.Files
+	}
+
+	seen := make(map[string]string)
+	dec := xml.NewDecoder(r)
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return report, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "siteinfo":
+			var info mwSiteInfo
+			err := dec.DecodeElement(&info, &start)
+			if err != nil {
+				return report, err
+			}
+			for _, ns := range info.Namespaces {
+				wiki.addNamespace(ns.Key, ns.Name, opts.Namespaces)
+			}
+		case "page":
+			var page mwPage
+			err := dec.DecodeElement(&page, &start)
+			if err != nil {
+				return report, err
+			}
+			err = wiki.importPage(ctx, client, db, blobs, page, opts, seen, &report, w)
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if !opts.DryRun {
+		_, err := client.Refresh(PageIndex).Do(ctx)
+		if err != nil {
+			return report, err
+		}
+	}
+	fmt.Fprintf(w, "%d pages created, %d replaced, %d files uploaded, %d conflicts\n", len(report.Created), len(report.Replaced), len(report.Files), len(report.Conflicts))
+	return report, nil
+}
+
+func newMediaWiki(prefix string) *mediaWiki {
+	return &mediaWiki{
+		prefix: "/" + strings.Trim(prefix, "/"),
+		// The canonical names are known even when a dump omits them.
+		namespaces: map[string]int{"file": mwNamespaceFile, "image": mwNamespaceFile, "media": -2, "category": mwNamespaceCategory},
+		paths:      make(map[int]string),
+	}
+}
+
+func (m *mediaWiki) addNamespace(key int, name string, paths map[string]string) {
+	if len(name) == 0 {
+		return
+	}
+	m.namespaces[strings.ToLower(name)] = key
+	if p, ok := paths[name]; ok {
+		m.paths[key] = "/" + strings.Trim(p, "/")
+		return
+	}
+	m.paths[key] = path.Join(m.prefix, strings.ToLower(mwPathElement(name)))
+}
+
+func (m *mediaWiki) importPage(ctx context.Context, client *elastic.Client, db *bolt.DB, blobs BlobStore, mw mwPage, opts MediaWikiOptions, seen map[string]string, report *ImportReport, w io.Writer) error {
+	switch {
+	case mw.NS < 0, mw.NS%2 == 1, mw.NS == mwNamespaceFile, mw.NS == mwNamespaceMediaWiki, mw.NS == mwNamespaceTemplate, mw.NS == mwNamespaceCategory, mw.NS == mwNamespaceModule:
+		fmt.Fprintf(w, "skipped %s\n", mw.Title)
+		return nil
+	case len(mw.Revisions) == 0:
+		return nil
+	}
+
+	pagePath := m.pagePath(mw.Title)
+	if other, ok := seen[pagePath]; ok {
+		report.conflict(w, pagePath, mw.Title, "also imported from "+other)
+		return nil
+	}
+	seen[pagePath] = mw.Title
+	exists, err := pageExists(ctx, client, pagePath)
+	if err != nil {
+		return err
+	}
+	if exists && !opts.Overwrite {
+		report.conflict(w, pagePath, mw.Title, "page already exists")
+		return nil
+	}
+
+	_, title := m.split(mw.Title)
+	// Only the files the page uses now are uploaded.
+	files := make(map[string]string)
+	var revisions []PageRevision
+	var tags []string
+	sort.SliceStable(mw.Revisions, func(i, j int) bool { return mw.Revisions[i].Timestamp < mw.Revisions[j].Timestamp })
+	for i, rev := range mw.Revisions {
+		var record map[string]string
+		if i == len(mw.Revisions)-1 {
+			record = files
+		}
+		text := rev.Text
+		if mw.Redirect != nil && i == len(mw.Revisions)-1 {
+			text = "This page has moved to [[" + mw.Redirect.Title + "]]."
+		}
+		body, categories := m.markdown(text, pagePath, record)
+		updated, _ := time.Parse(time.RFC3339, rev.Timestamp)
+		revisions = append(revisions, PageRevision{
+			Body:     "# " + mwDisplayTitle(title) + "\n\n" + body,
+			EditedBy: rev.author(),
+			Updated:  updated,
+			Comment:  rev.Comment,
+		})
+		tags = categories
+	}
+	current := revisions[len(revisions)-1]
+
+	var uploads []string
+	for name := range files {
+		uploads = append(uploads, name)
+	}
+	sort.Strings(uploads)
+	for _, name := range uploads {
+		filePath := files[name]
+		source, ok := m.files[mwFileKey(name)]
+		if !ok {
+			fmt.Fprintf(w, "missing file %s used by %s, upload it to %s\n", name, pagePath, filePath)
+			continue
+		}
+		report.Files = append(report.Files, filePath)
+		if opts.DryRun {
+			fmt.Fprintf(w, "would upload %s to %s\n", name, filePath)
+			continue
+		}
+		err := importFile(ctx, client, db, blobs, m.filesDir, source, filePath, current.EditedBy)
+		if err == errNotImportable {
+			fmt.Fprintf(w, "skipped %s: %v\n", name, err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "uploaded %s to %s\n", name, filePath)
+	}
+
+	verb := "created"
+	if exists {
+		verb = "replaced"
+		report.Replaced = append(report.Replaced, pagePath)
+	} else {
+		report.Created = append(report.Created, pagePath)
+	}
+	if opts.DryRun {
+		fmt.Fprintf(w, "would have %s %s from %s with %d revisions\n", verb, pagePath, mw.Title, len(revisions))
+		return nil
+	}
+	err = NewPage(client, pagePath, Page{
+		Path:        pagePath,
+		Body:        current.Body,
+		LastUpdated: current.Updated,
+		EditedBy:    current.EditedBy,
+		Tags:        tags,
+	})
+	if err != nil {
+		return err
+	}
+	// The history of a replaced page is replaced too, so that importing
+	// again does not repeat it.
+	err = ReplacePageRevisions(db, pagePath, revisions...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s %s from %s with %d revisions\n", verb, pagePath, mw.Title, len(revisions))
+	return nil
+}
+
+// split separates the namespace of a title from the rest of it. The first
+// letter of the rest is upper case, as MediaWiki does not tell them apart.
+func (m *mediaWiki) split(title string) (int, string) {
+	if i := strings.Index(title, ":"); i > 0 {
+		if ns, ok := m.namespaces[strings.ToLower(strings.TrimSpace(title[:i]))]; ok {
+			return ns, mwCapitalize(strings.TrimSpace(title[i+1:]))
+		}
+	}
+	return 0, mwCapitalize(title)
+}
+
+func mwCapitalize(title string) string {
+	r, n := utf8.DecodeRuneInString(title)
+	if r == utf8.RuneError {
+		return title
+	}
+	return string(unicode.ToUpper(r)) + title[n:]
+}
+
+// pagePath is where the page with a MediaWiki title is imported to. Subpages
+// become pages under their parent.
+func (m *mediaWiki) pagePath(title string) string {
+	ns, rest := m.split(strings.Replace(title, "_", " ", -1))
+	base, ok := m.paths[ns]
+	if !ok {
+		base = m.prefix
+	}
+	var elems []string
+	for _, elem := range strings.Split(rest, "/") {
+		if elem = mwPathElement(elem); len(elem) > 0 {
+			elems = append(elems, elem)
+		}
+	}
+	p := path.Join(base, strings.Join(elems, "/"))
+	if p == "/" {
+		return "/home"
+	}
+	return p
+}
+
+func mwPathElement(s string) string {
+	return strings.Trim(mwTitleChars.ReplaceAllString(strings.TrimSpace(s), "-"), "-.")
+}
+
+// mwDisplayTitle is the title of a page without its namespace or parents.
+func mwDisplayTitle(title string) string {
+	title = strings.Replace(title, "_", " ", -1)
+	if i := strings.LastIndex(title, "/"); i >= 0 && i < len(title)-1 {
+		title = title[i+1:]
+	}
+	return title
+}
+
+func mwFileKey(name string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(name), " ", "_", -1))
+}
+
+// mediaWikiFiles finds the original of every file in the images directory of
+// a MediaWiki, by name.
+func mediaWikiFiles(dir string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			switch info.Name() {
+			case "thumb", "archive", "temp", "deleted", "lockdir":
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") || !info.Mode().IsRegular() {
+			return nil
+		}
+		files[mwFileKey(info.Name())] = name
+		return nil
+	})
+	return files, err
+}
+
+// markdown converts wikitext from the page at pagePath into markdown,
+// returning the categories of the page separately. When files is not nil,
+// the files the page uses are added to it, each with the path it is
+// uploaded to.
+func (m *mediaWiki) markdown(text, pagePath string, files map[string]string) (string, []string) {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+
+	// Keep verbatim text out of the way of the conversion.
+	var verbatim []string
+	text = mwVerbatim.ReplaceAllStringFunc(text, func(s string) string {
+		g := mwVerbatim.FindStringSubmatch(s)
+		content := g[3]
+		if g[1] == "nowiki" {
+			content = html.EscapeString(content)
+		} else {
+			lang := ""
+			if l := mwLang.FindStringSubmatch(g[2]); l != nil {
+				lang = l[1]
+			}
+			content = "\n```" + lang + "\n" + strings.Trim(content, "\n") + "\n```\n"
+		}
+		verbatim = append(verbatim, content)
+		return "\x00" + strconv.Itoa(len(verbatim)-1) + "\x00"
+	})
+
+	text = mwComment.ReplaceAllString(text, "")
+	text = mwEmptyTag.ReplaceAllString(text, "")
+	text = mwMagicWord.ReplaceAllString(text, "")
+	text = mwRef.ReplaceAllString(text, " ($1)")
+	// Templates cannot be expanded without the MediaWiki that defines them.
+	text = removeBalanced(text, "{{", "}}")
+
+	var categories []string
+	text = replaceWikiLinks(text, func(inner, trail string) string {
+		return m.link(inner, trail, pagePath, files, &categories)
+	})
+	text = mwExternal.ReplaceAllStringFunc(text, func(s string) string {
+		g := mwExternal.FindStringSubmatch(s)
+		if len(strings.TrimSpace(g[2])) == 0 {
+			return "<" + g[1] + ">"
+		}
+		return "[" + g[2] + "](" + g[1] + ")"
+	})
+	text = mwCategoryLink.ReplaceAllString(text, "")
+
+	// Lines are converted before bold and italic text, whose asterisks would
+	// otherwise start lists.
+	text = mwBlocks(text)
+	text = mwBoldItalic.ReplaceAllString(text, "***$1***")
+	text = mwBold.ReplaceAllString(text, "**$1**")
+	text = mwItalic.ReplaceAllString(text, "*$1*")
+
+	text = mwPlaceholder.ReplaceAllStringFunc(text, func(s string) string {
+		i, _ := strconv.Atoi(mwPlaceholder.FindStringSubmatch(s)[1])
+		return verbatim[i]
+	})
+	text = mwBlankLines.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text), categories
+}
+
+// link converts the inside of a [[link]], followed by trail, the letters
+// which join onto its text.
+func (m *mediaWiki) link(inner, trail, pagePath string, files map[string]string, categories *[]string) string {
+	params := strings.Split(inner, "|")
+	target := strings.TrimSpace(params[0])
+	// A leading colon links to a file or category rather than using it.
+	colon := strings.HasPrefix(target, ":")
+	target = strings.TrimPrefix(target, ":")
+	ns, rest := m.split(target)
+
+	switch {
+	case ns == mwNamespaceCategory && !colon:
+		*categories = append(*categories, rest)
+		// Removed along with the spaces after it once every link is converted.
+		return "\x01"
+	case ns == mwNamespaceFile && !colon, ns == -2:
+		filePath := m.filePath(rest, pagePath, files)
+		var alt, caption string
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			switch {
+			case strings.HasPrefix(param, "alt="):
+				alt = strings.TrimPrefix(param, "alt=")
+			case !mwImageOption.MatchString(param):
+				caption = param
+			}
+		}
+		if len(alt) == 0 {
+			// Links in a caption cannot be kept in the text of an image.
+			alt = markdownInlineLink.ReplaceAllString(caption, "$1")
+		}
+		if ns == -2 || !Resizable(DetectContentType(rest, nil)) {
+			if len(caption) == 0 {
+				caption = rest
+			}
+			return "[" + caption + "](/storage" + filePath + ")"
+		}
+		return "![" + alt + "](/storage" + filePath + ")"
+	}
+
+	text := target
+	if len(params) > 1 {
+		text = strings.Join(params[1:], "|")
+		if len(text) == 0 {
+			// The pipe trick hides the namespace.
+			text = rest
+		}
+	}
+	text += trail
+
+	var anchor string
+	if i := strings.Index(target, "#"); i >= 0 {
+		target, anchor = target[:i], target[i+1:]
+	}
+	href := "/w" + m.pagePath(target)
+	if len(strings.TrimSpace(target)) == 0 {
+		href = "/w" + pagePath
+	}
+	if len(anchor) > 0 {
+		href += "#" + strings.ToLower(mwPathElement(anchor))
+	}
+	return "[" + text + "](" + href + ")"
+}
+
+// filePath is where a file used by the page at pagePath is uploaded to.
+func (m *mediaWiki) filePath(name, pagePath string, files map[string]string) string {
+	if files == nil {
+		files = make(map[string]string)
+	}
+	if filePath, ok := files[name]; ok {
+		return filePath
+	}
+	filePath := importFilePath(pagePath, strings.Replace(name, " ", "_", -1), files)
+	files[name] = filePath
+	return filePath
+}
+
+// mwBlocks converts the line based parts of wikitext: headings, lists,
+// tables, rules and preformatted text.
+func mwBlocks(text string) string {
+	var out []string
+	var table []string
+	var pre []string
+	flushPre := func() {
+		if len(pre) > 0 {
+			out = append(out, "```", strings.Join(pre, "\n"), "```")
+			pre = nil
+		}
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if len(table) > 0 || strings.HasPrefix(trimmed, "{|") {
+			table = append(table, trimmed)
+			if strings.HasPrefix(trimmed, "|}") {
+				flushPre()
+				out = append(out, "", mwTable(table), "")
+				table = nil
+			}
+			continue
+		}
+		if strings.HasPrefix(line, " ") && len(trimmed) > 0 {
+			pre = append(pre, line[1:])
+			continue
+		}
+		flushPre()
+
+		switch {
+		case mwHeading.MatchString(line):
+			g := mwHeading.FindStringSubmatch(line)
+			out = append(out, "", strings.Repeat("#", len(g[1]))+" "+g[2], "")
+		case mwRule.MatchString(line):
+			out = append(out, "", "---", "")
+		case mwList.MatchString(line):
+			g := mwList.FindStringSubmatch(line)
+			out = append(out, mwListItem(g[1], g[2]))
+		default:
+			out = append(out, line)
+		}
+	}
+	flushPre()
+	if len(table) > 0 {
+		out = append(out, mwTable(table))
+	}
+	return strings.Join(out, "\n")
+}
+
+func mwListItem(markers, item string) string {
+	indent := strings.Repeat("    ", len(markers)-1)
+	switch markers[len(markers)-1] {
+	case '*':
+		return indent + "- " + item
+	case '#':
+		return indent + "1. " + item
+	case ';':
+		if i := strings.Index(item, " : "); i >= 0 {
+			return indent + "**" + strings.TrimSpace(item[:i]) + "**: " + strings.TrimSpace(item[i+3:])
+		}
+		return indent + "**" + item + "**"
+	default:
+		if len(markers) == 1 {
+			return "> " + item
+		}
+		return indent + item
+	}
+}
+
+// mwTable converts the lines of a wikitext table into a markdown table. The
+// first row is the heading.
+func mwTable(lines []string) string {
+	var rows [][]string
+	var caption string
+	var row []string
+	endRow := func() {
+		if len(row) > 0 {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	cells := func(line, sep string) {
+		for _, cell := range strings.Split(line, sep) {
+			// Attributes come before a single bar.
+			if i := strings.Index(cell, "|"); i >= 0 {
+				cell = cell[i+1:]
+			}
+			row = append(row, strings.Replace(strings.TrimSpace(cell), "|", `\|`, -1))
+		}
+	}
+
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "{|"), strings.HasPrefix(line, "|}"):
+			endRow()
+		case strings.HasPrefix(line, "|+"):
+			caption = strings.TrimSpace(line[2:])
+		case strings.HasPrefix(line, "|-"):
+			endRow()
+		case strings.HasPrefix(line, "!"):
+			cells(strings.Replace(line[1:], "||", "!!", -1), "!!")
+		case strings.HasPrefix(line, "|"):
+			cells(line[1:], "||")
+		case len(row) > 0 && len(line) > 0:
+			// A cell carries on over more than one line.
+			row[len(row)-1] += " " + line
+		}
+	}
+	endRow()
+	if len(rows) == 0 {
+		return ""
+	}
+
+	columns := 0
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+	var b strings.Builder
+	if len(caption) > 0 {
+		b.WriteString("**" + caption + "**\n\n")
+	}
+	for i, row := range rows {
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		b.WriteString("| " + strings.Join(row, " | ") + " |\n")
+		if i == 0 {
+			b.WriteString("|" + strings.Repeat(" --- |", columns) + "\n")
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// replaceWikiLinks replaces each [[link]] in s, innermost first, with what f
+// returns for the text inside it and the letters which follow it.
+func replaceWikiLinks(s string, f func(inner, trail string) string) string {
+	var out strings.Builder
+	for {
+		i := strings.Index(s, "[[")
+		if i < 0 {
+			out.WriteString(s)
+			return out.String()
+		}
+		out.WriteString(s[:i])
+		end := balancedEnd(s[i:], "[[", "]]")
+		if end < 0 {
+			out.WriteString("[[")
+			s = s[i+2:]
+			continue
+		}
+		end += i
+		inner := replaceWikiLinks(s[i+2:end-2], f)
+		k := end
+		for k < len(s) && s[k] >= 'a' && s[k] <= 'z' {
+			k++
+		}
+		out.WriteString(f(inner, s[end:k]))
+		s = s[k:]
+	}
+}
+
+// removeBalanced removes everything from open to its matching close in s.
+func removeBalanced(s, open, close string) string {
+	var out strings.Builder
+	for {
+		i := strings.Index(s, open)
+		if i < 0 {
+			out.WriteString(s)
+			return out.String()
+		}
+		out.WriteString(s[:i])
+		end := balancedEnd(s[i:], open, close)
+		if end < 0 {
+			out.WriteString(s[i:])
+			return out.String()
+		}
+		s = s[i+end:]
+	}
+}
+
+// balancedEnd is the index just after the close matching the open which s
+// starts with, or -1 when it is never closed.
+func balancedEnd(s, open, close string) int {
+	depth := 0
+	for j := 0; j < len(s); {
+		switch {
+		case strings.HasPrefix(s[j:], open):
+			depth++
+			j += len(open)
+		case strings.HasPrefix(s[j:], close):
+			depth--
+			j += len(close)
+			if depth == 0 {
+				return j
+			}
+		default:
+			j++
+		}
+	}
+	return -1
+}
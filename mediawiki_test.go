@@ -0,0 +1,86 @@
+package wikie
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMediaWikiMarkdown(t *testing.T) {
+	m := newMediaWiki("/wiki")
+	m.addNamespace(4, "Project", nil)
+	for _, test := range []struct {
+		name, text, want string
+		categories       []string
+		files            map[string]string
+	}{
+		{
+			name: "headings",
+			text: "== Heading ==\ntext\n=== Sub ===",
+			want: "## Heading\n\ntext\n\n### Sub",
+		},
+		{
+			name: "lists",
+			text: "* a\n** b\n# one\n## two\n; term : def\n: quoted",
+			want: "- a\n    - b\n1. one\n    1. two\n**term**: def\n> quoted",
+		},
+		{
+			name: "table",
+			text: "{| class=\"wikitable\"\n|+ Caption\n! A !! B\n|-\n| 1 || 2\n|-\n| style=\"x\" | 3\n|}",
+			want: "**Caption**\n\n| A | B |\n| --- | --- |\n| 1 | 2 |\n| 3 |  |",
+		},
+		{
+			name: "links",
+			text: "[[foo bar]] and [[Foo bar|the page]]s and [[Project:rules#Section one]] and [[#local]]",
+			want: "[foo bar](/w/wiki/Foo-bar) and [the pages](/w/wiki/Foo-bar) and [Project:rules#Section one](/w/wiki/project/Rules#section-one) and [#local](/w/wiki/Page#local)",
+		},
+		{
+			name:  "images",
+			text:  "[[File:cat photo.jpg|thumb|200px|A [[cat]]]] [[Media:doc.pdf]] [[File:notes.pdf|Notes]]",
+			want:  "![A cat](/storage/wiki/Page/Cat_photo.jpg) [Doc.pdf](/storage/wiki/Page/Doc.pdf) [Notes](/storage/wiki/Page/Notes.pdf)",
+			files: map[string]string{"Cat photo.jpg": "/wiki/Page/Cat_photo.jpg", "Doc.pdf": "/wiki/Page/Doc.pdf", "Notes.pdf": "/wiki/Page/Notes.pdf"},
+		},
+		{
+			name:       "categories",
+			text:       "[[Category:animals]] [[:Category:plants]] text\n[[Category:Cats]]",
+			want:       "[Category:plants](/w/wiki/Plants) text",
+			categories: []string{"Animals", "Cats"},
+		},
+		{
+			name: "inline",
+			text: "'''bold''' ''it'' [https://example.org Example] <nowiki>[[x]]</nowiki> {{template|x}}",
+			want: "**bold** *it* [Example](https://example.org) [[x]]",
+		},
+	} {
+		files := make(map[string]string)
+		got, categories := m.markdown(test.text, "/wiki/Page", files)
+		if got != test.want {
+			t.Errorf("%s: markdown = %q, want %q", test.name, got, test.want)
+		}
+		if !reflect.DeepEqual(categories, test.categories) {
+			t.Errorf("%s: categories = %v, want %v", test.name, categories, test.categories)
+		}
+		if len(files) > 0 || len(test.files) > 0 {
+			if !reflect.DeepEqual(files, test.files) {
+				t.Errorf("%s: files = %v, want %v", test.name, files, test.files)
+			}
+		}
+	}
+}
+
+func TestMediaWikiPagePath(t *testing.T) {
+	m := newMediaWiki("/wiki")
+	m.addNamespace(4, "Project", nil)
+	for _, test := range []struct {
+		title, want string
+	}{
+		{"foo_bar", "/wiki/Foo-bar"},
+		{"Foo bar", "/wiki/Foo-bar"},
+		{"project:rules/sub page", "/wiki/project/Rules/sub-page"},
+		{"ärger", "/wiki/Ärger"},
+		{"What? (draft)", "/wiki/What-draft"},
+	} {
+		if got := m.pagePath(test.title); got != test.want {
+			t.Errorf("pagePath(%q) = %q, want %q", test.title, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package wikie
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// sniffLen is how much of a file is read to detect its type.
+const sniffLen = 512
+
+// inlineTypes are the types of uploaded file that browsers may display
+// directly. Anything else, HTML and SVG in particular, could run script in
+// wikie's origin and so is only ever downloaded.
+var inlineTypes = map[string]bool{
+	"application/pdf": true,
+	"text/plain":      true,
+	"text/csv":        true,
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/bmp":       true,
+	"image/x-icon":    true,
+	"audio/mpeg":      true,
+	"audio/ogg":       true,
+	"audio/wave":      true,
+	"audio/wav":       true,
+	"video/mp4":       true,
+	"video/webm":      true,
+	"video/ogg":       true,
+}
+
+// DetectContentType returns the type of a file from the start of its contents,
+// falling back to the extension of name when the contents are not conclusive.
+func DetectContentType(name string, head []byte) string {
+	sniffed := http.DetectContentType(head)
+	byExt := mime.TypeByExtension(strings.ToLower(path.Ext(name)))
+	switch mediaType(sniffed) {
+	case "application/octet-stream", "text/plain", "text/xml", "application/zip":
+		// These are what the sniffer reports for many formats it cannot tell
+		// apart (e.g. SVG is XML, DOCX is a zip), so the extension says more.
+		if len(byExt) > 0 {
+			return byExt
+		}
+	}
+	return sniffed
+}
+
+// SniffContentType detects the type of the file in r and rewinds it.
+func SniffContentType(name string, r io.ReadSeeker) (string, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return DetectContentType(name, head[:n]), err
+}
+
+// Inline reports whether a file of contentType is safe to display in the browser.
+func Inline(contentType string) bool {
+	return inlineTypes[mediaType(contentType)]
+}
+
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	}
+	return t
+}
@@ -1,15 +1,32 @@
 package wikie
 
 import (
-	"bytes"
-	"fmt"
+	"github.com/go-errors/errors"
 	"github.com/gomarkdown/markdown"
-	"github.com/jlubawy/go-boilerpipe"
-	"gopkg.in/neurosnap/sentences.v1"
 	"html/template"
+	"path"
 	"strings"
+	"time"
 )
 
+// ErrUnsafePagePath is returned for page paths which are not in their clean
+// form, as pages are also written to files named after their paths.
+var ErrUnsafePagePath = errors.New("unsafe page path")
+
+// CheckPagePath returns ErrUnsafePagePath unless p is an absolute page path in
+// its clean form, without any .. elements.
+func CheckPagePath(p string) error {
+	if !strings.HasPrefix(p, "/") || path.Clean(p) != p || strings.ContainsAny(p, "\\\x00") {
+		return ErrUnsafePagePath
+	}
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." {
+			return ErrUnsafePagePath
+		}
+	}
+	return nil
+}
+
 type PageRelationship struct {
 	URL   string
 	Title string
@@ -17,59 +34,34 @@ type PageRelationship struct {
 
 type Page struct {
 	Path          string             `json:"path"`
+	Title         string             `json:"title"`
 	Body          string             `json:"body"`
-	Relationships []PageRelationship `json:"relationships"`
-	LastUpdated   string             `json:"updated"`
+	Relationships []PageRelationship `json:"-"`
+	LastUpdated   time.Time          `json:"updated"`
 	EditedBy      string             `json:"edited"`
 	Public        bool               `json:"public"`
-	Files         []string
-}
-
-func (p Page) Render() template.HTML {
-	return template.HTML(string(markdown.ToHTML([]byte(p.Body), nil, nil)))
+	Tags          []string           `json:"tags"`
+	Files         []FileHistory      `json:"-"`
+	Version       int64              `json:"-"`
+	SeqNo         int64              `json:"-"`
+	PrimaryTerm   int64              `json:"-"`
+	Related       []Suggestion       `json:"-"`
+	Location      *time.Location     `json:"-"`
 }
 
-func (p Page) Snippet(query string) template.HTML {
-	s := []string{"<html><body>", string(markdown.ToHTML([]byte(p.Body), nil, nil)), "</body></html>"}
-	doc, err := boilerpipe.ParseDocument(bytes.NewBufferString(strings.Join(s, "")))
-
-	tokeniser := sentences.NewWordTokenizer(&sentences.DefaultPunctStrings{})
-	queryTerms := tokeniser.Tokenize(query, false)
-
-	if err != nil {
-		panic(err)
-	}
-	var blocks []string
-	for _, block := range doc.TextBlocks {
-		text := block.Text
-		skip := true
-		for _, queryTerm := range queryTerms {
-			if strings.Contains(strings.ToLower(text), strings.ToLower(queryTerm.Tok)) {
-				idx := strings.Index(strings.ToLower(text), strings.ToLower(queryTerm.Tok))
-				size := 125
-				if len(text) > size && idx > size && idx < len(text)-size {
-					text = fmt.Sprintf("...%s...", text[idx-125:idx+125])
-				} else if len(text) > size && idx > len(text)-size {
-					text = fmt.Sprintf("...%s", text[idx-125:])
-				}
-				skip = false
-				break
+// title is the text of the first heading in the body, or the last element of
+// the path when the page has no heading.
+func (p Page) title() string {
+	for _, line := range strings.Split(p.Body, "\n") {
+		if strings.HasPrefix(line, "#") {
+			if t := strings.TrimSpace(strings.TrimLeft(line, "#")); len(t) > 0 {
+				return t
 			}
 		}
-		if skip {
-			continue
-		}
-		for _, queryTerm := range queryTerms {
-			text = strings.Replace(text, queryTerm.Tok, fmt.Sprintf("<b>%s</b>", queryTerm.Tok), -1)
-			text = strings.Replace(text, strings.Title(queryTerm.Tok), fmt.Sprintf("<b>%s</b>", strings.Title(queryTerm.Tok)), -1)
-			text = strings.Replace(text, strings.ToUpper(queryTerm.Tok), fmt.Sprintf("<b>%s</b>", strings.ToUpper(queryTerm.Tok)), -1)
-			text = strings.Replace(text, strings.ToLower(queryTerm.Tok), fmt.Sprintf("<b>%s</b>", strings.ToLower(queryTerm.Tok)), -1)
-		}
-		blocks = append(blocks, text)
 	}
-	content := strings.Join(blocks, "...")
-	if len(content) > 250 {
-		return template.HTML(content)[:250] + "..."
-	}
-	return template.HTML(content)
+	return path.Base(p.Path)
+}
+
+func (p Page) Render() template.HTML {
+	return template.HTML(srcset(string(markdown.ToHTML([]byte(p.Body), nil, nil))))
 }
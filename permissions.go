@@ -33,6 +33,13 @@ func Init(db *bolt.DB, admins []string) error {
 	}
 
 	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"profiles", "files", "shares", "revisions", "sessions"} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+
 		bucket := tx.Bucket([]byte("perms"))
 
 		if bucket == nil {
@@ -101,6 +108,13 @@ func RemovePermission(db *bolt.DB, user, path string, access AccessType) error {
 	})
 }
 
+// UnderPath is whether p is the path prefix, or is below it. Permissions to a
+// path cover the pages below it, and search filters the same way.
+func UnderPath(p, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
 func HasPermission(db *bolt.DB, user, path string, access AccessType) (bool, error) {
 	granted := false
 	err := db.View(func(tx *bolt.Tx) error {
@@ -112,7 +126,7 @@ func HasPermission(db *bolt.DB, user, path string, access AccessType) (bool, err
 				return err
 			}
 			for _, perm := range perms {
-				if perm.Access >= access && strings.Contains(path, perm.Path) {
+				if perm.Access >= access && UnderPath(path, perm.Path) {
 					granted = true
 					return nil
 				}
@@ -123,6 +137,28 @@ func HasPermission(db *bolt.DB, user, path string, access AccessType) (bool, err
 	return granted, err
 }
 
+// ReadablePaths returns the path prefixes the user has been granted read access to.
+func ReadablePaths(db *bolt.DB, user string) ([]string, error) {
+	var paths []string
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("perms"))
+		if v := bucket.Get([]byte(user)); v != nil {
+			var perms []Permission
+			err := json.Unmarshal(v, &perms)
+			if err != nil {
+				return err
+			}
+			for _, perm := range perms {
+				if perm.Access >= PermissionRead {
+					paths = append(paths, perm.Path)
+				}
+			}
+		}
+		return nil
+	})
+	return paths, err
+}
+
 func GetPermissions(db *bolt.DB) (UserPermissions, error) {
 	userPerms := make(UserPermissions)
 	err := db.View(func(tx *bolt.Tx) error {
@@ -165,3 +201,20 @@ func GetUserPermissions(db *bolt.DB, user string) (UserPermissions, error) {
 	})
 	return userPerms, err
 }
+
+// RemoveUser forgets a user: their permissions, profile and sessions.
+func RemoveUser(db *bolt.DB, user string) error {
+	_, err := RemoveSessions(db, func(session Session) bool {
+		return session.User == user
+	})
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte("perms")).Delete([]byte(user))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("profiles")).Delete([]byte(user))
+	})
+}
@@ -0,0 +1,411 @@
+package wikie
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/go-errors/errors"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrUploadTooLarge is returned when a file is larger than the maximum upload size.
+	ErrUploadTooLarge = errors.New("file is larger than the maximum upload size")
+	// ErrQuotaExceeded is returned when a file would take a user or namespace over its quota.
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+	// ErrTypeNotAllowed is returned when files of a type may not be uploaded.
+	ErrTypeNotAllowed = errors.New("file type not allowed")
+)
+
+// StorageLimits configures what may be uploaded to storage. Sizes are written
+// like 20MB or 1.5GB, and an empty size is unlimited.
+type StorageLimits struct {
+	MaxUploadSize string `yaml:"maxUploadSize"`
+	UserQuota     string `yaml:"userQuota"`
+	// NamespaceQuotas limit everything stored under a namespace, e.g. /ops: 1GB.
+	NamespaceQuotas map[string]string `yaml:"namespaceQuotas"`
+	// AllowTypes, when set, are the only MIME types which may be uploaded.
+	// Types can end in a wildcard, e.g. image/*.
+	AllowTypes []string `yaml:"allowTypes"`
+	DenyTypes  []string `yaml:"denyTypes"`
+}
+
+// StoragePolicy is StorageLimits with the sizes parsed. Sizes of 0 are unlimited.
+type StoragePolicy struct {
+	MaxUploadSize   int64
+	UserQuota       int64
+	NamespaceQuotas map[string]int64
+	AllowTypes      []string
+	DenyTypes       []string
+}
+
+func (l StorageLimits) Policy() (StoragePolicy, error) {
+	var policy StoragePolicy
+	var err error
+	policy.MaxUploadSize, err = ParseSize(l.MaxUploadSize)
+	if err != nil {
+		return policy, fmt.Errorf("maxUploadSize: %v", err)
+	}
+	policy.UserQuota, err = ParseSize(l.UserQuota)
+	if err != nil {
+		return policy, fmt.Errorf("userQuota: %v", err)
+	}
+	policy.NamespaceQuotas = make(map[string]int64)
+	for namespace, quota := range l.NamespaceQuotas {
+		resolved, err := ResolveStoragePath(namespace)
+		if err != nil {
+			return policy, fmt.Errorf("namespaceQuotas: %s: %v", namespace, err)
+		}
+		policy.NamespaceQuotas[resolved], err = ParseSize(quota)
+		if err != nil {
+			return policy, fmt.Errorf("namespaceQuotas: %s: %v", namespace, err)
+		}
+	}
+	for _, t := range l.AllowTypes {
+		policy.AllowTypes = append(policy.AllowTypes, strings.ToLower(t))
+	}
+	for _, t := range l.DenyTypes {
+		policy.DenyTypes = append(policy.DenyTypes, strings.ToLower(t))
+	}
+	return policy, nil
+}
+
+// ParseSize parses a number of bytes with an optional unit, e.g. 512KB. Units
+// are powers of 1024, as in FormatSize.
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if len(s) == 0 {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	for i, unit := range []string{"KB", "MB", "GB", "TB"} {
+		if strings.HasSuffix(s, unit) {
+			multiplier = 1 << (10 * uint(i+1))
+			s = strings.TrimSuffix(s, unit)
+			break
+		}
+	}
+	s = strings.TrimSpace(strings.TrimSuffix(s, "B"))
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// CheckType returns ErrTypeNotAllowed if files of contentType may not be uploaded.
+func (p StoragePolicy) CheckType(contentType string) error {
+	t := mediaType(contentType)
+	for _, deny := range p.DenyTypes {
+		if matchType(deny, t) {
+			return fmt.Errorf("%w: %s", ErrTypeNotAllowed, t)
+		}
+	}
+	if len(p.AllowTypes) == 0 {
+		return nil
+	}
+	for _, allow := range p.AllowTypes {
+		if matchType(allow, t) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrTypeNotAllowed, t)
+}
+
+func matchType(pattern, t string) bool {
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(t, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == "*" || pattern == t
+}
+
+// Allowance returns how many bytes user may upload to filePath, or -1 if
+// there is no limit. The error is the one to report for a file larger than
+// the allowance.
+func (p StoragePolicy) Allowance(usage StorageUsage, user, filePath string) (int64, error) {
+	allowance := int64(-1)
+	var limit error
+	tighten := func(n int64, err error) {
+		if n < 0 {
+			n = 0
+		}
+		if allowance < 0 || n < allowance {
+			allowance, limit = n, err
+		}
+	}
+	if p.MaxUploadSize > 0 {
+		tighten(p.MaxUploadSize, fmt.Errorf("%w (%s)", ErrUploadTooLarge, FormatSize(p.MaxUploadSize)))
+	}
+	if p.UserQuota > 0 {
+		tighten(p.UserQuota-usage.ByUser(user), fmt.Errorf("%w: %s may store %s", ErrQuotaExceeded, user, FormatSize(p.UserQuota)))
+	}
+	for namespace, quota := range p.NamespaceQuotas {
+		if quota > 0 && underNamespace(filePath, namespace) {
+			tighten(quota-usage.Under(namespace), fmt.Errorf("%w: %s may hold %s", ErrQuotaExceeded, namespace, FormatSize(quota)))
+		}
+	}
+	return allowance, limit
+}
+
+// Reserve returns a check for StoreFile and RestoreFile which refuses a file
+// that would take user, or a namespace filePath is in, over its quota. It is
+// run in the transaction that records the file, against the totals kept in
+// it, so uploads made at the same time cannot together exceed a quota.
+func (p StoragePolicy) Reserve(user, filePath string) StorageCheck {
+	return func(tx *bolt.Tx, size int64) error {
+		usage, ok := readUsage(tx)
+		if !ok {
+			// The totals are built before anything is uploaded through the
+			// wiki, so only imports, which are not limited, get here.
+			return nil
+		}
+		allowance, limit := p.Allowance(usage, user, filePath)
+		if allowance >= 0 && size > allowance {
+			return limit
+		}
+		return nil
+	}
+}
+
+// RequestAllowance returns how large a request uploading files for user may
+// be before any of it is read, or -1 if there is no limit. Which namespaces
+// the files are in is not known yet, so only quotas which cover all of
+// storage are counted, and the largest upload only applies to a request with
+// a single file.
+func (p StoragePolicy) RequestAllowance(usage StorageUsage, user string, single bool) (int64, error) {
+	if !single {
+		p.MaxUploadSize = 0
+	}
+	return p.Allowance(usage, user, "")
+}
+
+func underNamespace(filePath, namespace string) bool {
+	return namespace == "/" || filePath == namespace || strings.HasPrefix(filePath, namespace+"/")
+}
+
+// LimitReader returns a reader which fails with err once more than n bytes
+// have been read from r. An n of -1 is unlimited.
+func LimitReader(r io.Reader, n int64, err error) io.Reader {
+	if n < 0 {
+		return r
+	}
+	return &limitedReader{r: r, n: n, err: err}
+}
+
+type limitedReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	// Read one byte past the limit so a file of exactly the limit is allowed.
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		return 0, l.err
+	}
+	l.n -= int64(n)
+	return n, err
+}
+
+// StorageUsage is how much space the files in storage take up, counting
+// every version that is kept.
+type StorageUsage struct {
+	// users and paths are the totals of each uploader and under each
+	// directory.
+	users map[string]int64
+	paths map[string]int64
+}
+
+// The usage bucket keeps the totals of StorageUsage, as 8 byte numbers under
+// "u" and the uploader or "p" and the directory. They are updated in the
+// transactions which record and remove versions, so that checking a quota
+// does not list storage, and are built from the histories, and from storage
+// for files uploaded before histories were kept, the first time they are
+// needed. Without the bucket, nothing is counted.
+
+// GetStorageUsage returns the totals of the files in storage, including those
+// uploaded before histories were kept.
+func GetStorageUsage(ctx context.Context, db *bolt.DB, blobs BlobStore) (StorageUsage, error) {
+	var usage StorageUsage
+	var ok bool
+	read := func(tx *bolt.Tx) error {
+		usage, ok = readUsage(tx)
+		return nil
+	}
+	err := db.View(read)
+	if err != nil || ok {
+		return usage, err
+	}
+	err = buildUsage(ctx, db, blobs)
+	if err != nil {
+		return usage, err
+	}
+	return usage, db.View(read)
+}
+
+func buildUsage(ctx context.Context, db *bolt.DB, blobs BlobStore) error {
+	current, err := blobs.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("usage")) != nil {
+			// Built at the same time.
+			return nil
+		}
+		_, err := tx.CreateBucket([]byte("usage"))
+		if err != nil {
+			return err
+		}
+		files := tx.Bucket([]byte("files"))
+		err = files.ForEach(func(k, v []byte) error {
+			var history FileHistory
+			err := json.Unmarshal(v, &history)
+			if err != nil {
+				return err
+			}
+			for _, version := range history.Versions {
+				err := countUsage(tx, string(k), version.Uploader, version.Size)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, blob := range current {
+			if files.Get([]byte("/"+blob.Key)) == nil {
+				err := countUsage(tx, "/"+blob.Key, "", blob.Size)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func readUsage(tx *bolt.Tx) (StorageUsage, bool) {
+	bucket := tx.Bucket([]byte("usage"))
+	if bucket == nil {
+		return StorageUsage{}, false
+	}
+	usage := StorageUsage{users: make(map[string]int64), paths: make(map[string]int64)}
+	bucket.ForEach(func(k, v []byte) error {
+		if len(k) == 0 || len(v) != 8 {
+			return nil
+		}
+		n := int64(binary.BigEndian.Uint64(v))
+		switch k[0] {
+		case 'u':
+			usage.users[string(k[1:])] = n
+		case 'p':
+			usage.paths[string(k[1:])] = n
+		}
+		return nil
+	})
+	return usage, true
+}
+
+// countUsage adds size, which is negative for space freed, to the totals of
+// uploader and of the directories filePath is in.
+func countUsage(tx *bolt.Tx, filePath, uploader string, size int64) error {
+	bucket := tx.Bucket([]byte("usage"))
+	if bucket == nil {
+		return nil
+	}
+	keys := []string{"u" + uploader}
+	for dir := path.Dir(filePath); ; dir = path.Dir(dir) {
+		keys = append(keys, "p"+dir)
+		if dir == "/" || dir == "." {
+			break
+		}
+	}
+	for _, k := range keys {
+		var total int64
+		if v := bucket.Get([]byte(k)); len(v) == 8 {
+			total = int64(binary.BigEndian.Uint64(v))
+		}
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(total+size))
+		err := bucket.Put([]byte(k), b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u StorageUsage) Total() int64 {
+	return u.Under("/")
+}
+
+// ByUser is the size of every version uploaded by user.
+func (u StorageUsage) ByUser(user string) int64 {
+	return u.users[user]
+}
+
+// Under is the size of every version of the files in namespace.
+func (u StorageUsage) Under(namespace string) int64 {
+	return u.paths[namespace]
+}
+
+// UsageEntry is the space used by one namespace or user.
+type UsageEntry struct {
+	Name string
+	Size int64
+}
+
+// Namespaces is the usage of each top level namespace, largest first. Files
+// at the top level are under /.
+func (u StorageUsage) Namespaces() []UsageEntry {
+	sizes := make(map[string]int64)
+	top := u.paths["/"]
+	for namespace, size := range u.paths {
+		if namespace != "/" && strings.Count(namespace, "/") == 1 && size > 0 {
+			sizes[namespace] = size
+			top -= size
+		}
+	}
+	if top > 0 {
+		sizes["/"] = top
+	}
+	return usageEntries(sizes)
+}
+
+// Users is the usage of each user who has uploaded files, largest first.
+func (u StorageUsage) Users() []UsageEntry {
+	sizes := make(map[string]int64)
+	for user, size := range u.users {
+		if len(user) > 0 && size > 0 {
+			sizes[user] = size
+		}
+	}
+	return usageEntries(sizes)
+}
+
+func usageEntries(sizes map[string]int64) []UsageEntry {
+	var entries []UsageEntry
+	for name, size := range sizes {
+		entries = append(entries, UsageEntry{Name: name, Size: size})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Size == entries[j].Size {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Size > entries[j].Size
+	})
+	return entries
+}
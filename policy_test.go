@@ -0,0 +1,102 @@
+package wikie
+
+import (
+	"context"
+	"github.com/boltdb/bolt"
+	"github.com/go-errors/errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"", 0, true},
+		{"512", 512, true},
+		{"512B", 512, true},
+		{"20MB", 20 << 20, true},
+		{"1.5gb", 3 << 29, true},
+		{" 2 KB ", 2048, true},
+		{"1TB", 1 << 40, true},
+		{"-1MB", 0, false},
+		{"MB", 0, false},
+		{"ten", 0, false},
+	} {
+		got, err := ParseSize(test.s)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", test.s, got, err, test.want)
+		}
+	}
+}
+
+func TestStorageUsage(t *testing.T) {
+	ctx := context.Background()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "perms.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = Init(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := NewLocalBlobStore(t.TempDir())
+
+	// A file uploaded before histories were kept is counted from storage.
+	err = blobs.Put(ctx, "old.txt", strings.NewReader("0123456789"), 10, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := func(filePath, body, user string, check StorageCheck) error {
+		_, err := StoreFile(ctx, db, blobs, filePath, strings.NewReader(body), "text/plain", user, check)
+		return err
+	}
+	err = store("/a/b/f.txt", "12345", "u", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := GetStorageUsage(ctx, db, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Total() != 15 || usage.Under("/a") != 5 || usage.Under("/a/b") != 5 || usage.ByUser("u") != 5 {
+		t.Errorf("usage = %d in total, %d under /a, %d under /a/b, %d by u", usage.Total(), usage.Under("/a"), usage.Under("/a/b"), usage.ByUser("u"))
+	}
+	namespaces := usage.Namespaces()
+	if len(namespaces) != 2 || namespaces[0] != (UsageEntry{"/", 10}) || namespaces[1] != (UsageEntry{"/a", 5}) {
+		t.Errorf("namespaces = %v", namespaces)
+	}
+
+	// Totals are kept as files are stored, so the quota is checked against them.
+	policy := StoragePolicy{UserQuota: 8}
+	err = store("/a/g.txt", "123", "u", policy.Reserve("u", "/a/g.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store("/a/h.txt", "1", "u", policy.Reserve("u", "/a/h.txt"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("upload over the quota = %v", err)
+	}
+	// Replacing a file from before histories were kept does not count it twice.
+	err = store("/old.txt", "01234", "v", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DeleteFile(ctx, db, blobs, "/a/b/f.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err = GetStorageUsage(ctx, db, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Total() != 18 || usage.Under("/a") != 3 || usage.ByUser("u") != 3 || usage.ByUser("v") != 5 {
+		t.Errorf("usage = %d in total, %d under /a, %d by u, %d by v", usage.Total(), usage.Under("/a"), usage.ByUser("u"), usage.ByUser("v"))
+	}
+}
@@ -0,0 +1,56 @@
+package wikie
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/go-errors/errors"
+	"time"
+)
+
+// ErrUnknownTimezone is returned when a profile is given a timezone that does not exist.
+var ErrUnknownTimezone = errors.New("unknown timezone")
+
+// Profile holds the preferences of a user.
+type Profile struct {
+	// Timezone is the IANA name of the zone times are displayed in, e.g. Australia/Brisbane.
+	Timezone string `json:"timezone"`
+}
+
+// Location returns the time zone of the profile, defaulting to UTC.
+func (p Profile) Location() *time.Location {
+	if len(p.Timezone) == 0 {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func GetProfile(db *bolt.DB, user string) (Profile, error) {
+	var profile Profile
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("profiles"))
+		if v := bucket.Get([]byte(user)); v != nil {
+			return json.Unmarshal(v, &profile)
+		}
+		return nil
+	})
+	return profile, err
+}
+
+func SetProfile(db *bolt.DB, user string, profile Profile) error {
+	if len(profile.Timezone) > 0 {
+		if _, err := time.LoadLocation(profile.Timezone); err != nil {
+			return ErrUnknownTimezone
+		}
+	}
+	b, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("profiles")).Put([]byte(user), b)
+	})
+}
@@ -0,0 +1,190 @@
+package wikie
+
+import (
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// PageTreeEntry is a page listed in a tree of pages, at Depth levels below
+// the root.
+type PageTreeEntry struct {
+	Suggestion
+	Depth int
+}
+
+// PageTree arranges pages, sorted by path, into a tree.
+func PageTree(pages []Suggestion) []PageTreeEntry {
+	var tree []PageTreeEntry
+	for _, page := range pages {
+		tree = append(tree, PageTreeEntry{page, strings.Count(strings.Trim(page.Path, "/"), "/")})
+	}
+	return tree
+}
+
+// What a link in a page points at.
+const (
+	linkExternal = iota
+	linkPage
+	linkFile
+	linkWikie
+)
+
+// resolveLink works out what a link in the page at pagePath points at, and
+// for pages and files in storage, their path.
+func resolveLink(u *url.URL, pagePath string) (int, string) {
+	if len(u.Scheme) > 0 || len(u.Host) > 0 || len(u.Path) == 0 {
+		return linkExternal, ""
+	}
+	var target string
+	switch {
+	case u.Path == "/w" || u.Path == "/public":
+		target = "/"
+	case strings.HasPrefix(u.Path, "/w/"):
+		target = strings.TrimPrefix(u.Path, "/w")
+	case strings.HasPrefix(u.Path, "/public/"):
+		target = strings.TrimPrefix(u.Path, "/public")
+	case strings.HasPrefix(u.Path, "/storage/"):
+		filePath, err := ResolveStoragePath(strings.TrimPrefix(u.Path, "/storage"))
+		if err != nil {
+			return linkWikie, ""
+		}
+		return linkFile, filePath
+	case strings.HasPrefix(u.Path, "/"):
+		return linkWikie, ""
+	default:
+		target = path.Join(path.Dir(pagePath), u.Path)
+	}
+	return linkPage, path.Clean(target)
+}
+
+// PublicLinks rewrites the links in body, rendered from the page at pagePath,
+// for the public site: links to public pages point at /public, and links to
+// any other part of the wiki, which would need an account, become plain text.
+// Files, and images, stay only if they have been published.
+func PublicLinks(body, pagePath string, public map[string]bool, published func(filePath string) bool) string {
+	return rewriteLinks(body, pagePath, func(target, fragment string) (string, bool) {
+		if target != "/" && !public[target] {
+			return "", false
+		}
+		return (&url.URL{Path: path.Join("/public", target), Fragment: fragment}).String(), true
+	}, func(target string) (string, bool) {
+		return "/storage" + target, published(target)
+	})
+}
+
+// rewriteLinks rewrites the links and images in body, rendered from the page
+// at pagePath, that point at pages and files in the wiki. page and file
+// return where a link to a page, with its fragment, or to a file should point
+// instead, or false when it should become plain text. Links to the rest of
+// the wiki become plain text too, and images which cannot be shown become
+// their alternative text. The resized variants of images are dropped, as they
+// are only served to those who can read the wiki.
+func rewriteLinks(body, pagePath string, page func(target, fragment string) (string, bool), file func(target string) (string, bool)) string {
+	var b strings.Builder
+	// Whether each open link has been made plain text, so that its end tag
+	// can be dropped too.
+	var dropped []bool
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return b.String()
+		}
+		raw := string(z.Raw())
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.DataAtom {
+			case atom.A:
+				href, ok := linkTarget(t, "href", pagePath, page, file)
+				if tt == html.StartTagToken {
+					dropped = append(dropped, !ok)
+				}
+				if !ok {
+					continue
+				}
+				if len(href) > 0 {
+					setAttr(&t, "href", href)
+				}
+				raw = t.String()
+			case atom.Img:
+				src, ok := linkTarget(t, "src", pagePath, page, file)
+				if !ok {
+					b.WriteString(html.EscapeString(attr(t, "alt")))
+					continue
+				}
+				if len(src) > 0 {
+					setAttr(&t, "src", src)
+					removeAttr(&t, "srcset")
+					removeAttr(&t, "sizes")
+				}
+				raw = t.String()
+			}
+		case html.EndTagToken:
+			if t := z.Token(); t.DataAtom == atom.A && len(dropped) > 0 {
+				drop := dropped[len(dropped)-1]
+				dropped = dropped[:len(dropped)-1]
+				if drop {
+					continue
+				}
+			}
+		}
+		b.WriteString(raw)
+	}
+}
+
+// linkTarget resolves the link in the attribute key of t, returning where it
+// should point instead, or false if it should be removed. An empty target
+// leaves the link, such as one to another site, as it is.
+func linkTarget(t html.Token, key, pagePath string, page func(target, fragment string) (string, bool), file func(target string) (string, bool)) (string, bool) {
+	u, err := url.Parse(attr(t, key))
+	if err != nil {
+		return "", true
+	}
+	switch kind, target := resolveLink(u, pagePath); kind {
+	case linkExternal:
+		return "", true
+	case linkPage:
+		if t.DataAtom != atom.A {
+			return "", false
+		}
+		return page(target, u.Fragment)
+	case linkFile:
+		href, ok := file(target)
+		if ok && len(u.Fragment) > 0 {
+			href += "#" + u.Fragment
+		}
+		return href, ok
+	}
+	return "", false
+}
+
+func attr(t html.Token, key string) string {
+	for _, a := range t.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func setAttr(t *html.Token, key, val string) {
+	for i, a := range t.Attr {
+		if a.Namespace == "" && a.Key == key {
+			t.Attr[i].Val = val
+		}
+	}
+}
+
+func removeAttr(t *html.Token, key string) {
+	attrs := t.Attr[:0]
+	for _, a := range t.Attr {
+		if a.Namespace != "" || a.Key != key {
+			attrs = append(attrs, a)
+		}
+	}
+	t.Attr = attrs
+}
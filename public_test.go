@@ -0,0 +1,30 @@
+package wikie
+
+import "testing"
+
+func TestPublicLinks(t *testing.T) {
+	public := map[string]bool{"/a/b": true, "/c": true}
+	published := func(filePath string) bool {
+		return filePath == "/a/f.pdf" || filePath == "/a/p.png"
+	}
+	for _, test := range []struct {
+		body, want string
+	}{
+		{`<a href="/w/a/b">b</a>`, `<a href="/public/a/b">b</a>`},
+		// The href need not be the first attribute.
+		{`<a target="_blank" href="/w/a/b">b</a>`, `<a target="_blank" href="/public/a/b">b</a>`},
+		{`<a class="x" href="/w/private"><b>private</b></a>`, `<b>private</b>`},
+		{`<a href="../c#top" title="a > b">c</a>`, `<a href="/public/c#top" title="a &gt; b">c</a>`},
+		{`<a href="/search?q=x">search</a>`, `search`},
+		{`<a href="https://example.org/?a=1&amp;b=2">out</a>`, `<a href="https://example.org/?a=1&amp;b=2">out</a>`},
+		{`<a name="top">top</a>`, `<a name="top">top</a>`},
+		{`<a href="/storage/a/f.pdf">f</a> <a href="/storage/a/g.pdf">g</a>`, `<a href="/storage/a/f.pdf">f</a> g`},
+		{`<img alt="p" src="/storage/a/p.png" srcset="/storage/a/p.png?w=320 320w" sizes="100vw" />`, `<img alt="p" src="/storage/a/p.png"/>`},
+		{`<img src="/storage/a/q.png" alt="q &amp; r">`, `q &amp; r`},
+		{`<script>var a = "<a href='/w/private'>x</a>";</script>`, `<script>var a = "<a href='/w/private'>x</a>";</script>`},
+	} {
+		if got := PublicLinks(test.body, "/a/x", public, published); got != test.want {
+			t.Errorf("PublicLinks(%s) = %s, want %s", test.body, got, test.want)
+		}
+	}
+}
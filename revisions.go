@@ -0,0 +1,155 @@
+package wikie
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"time"
+)
+
+// PageRevision is the content of a page as it was saved at one time.
+type PageRevision struct {
+	Version  int       `json:"version"`
+	Body     string    `json:"body"`
+	EditedBy string    `json:"edited"`
+	Updated  time.Time `json:"updated"`
+	Comment  string    `json:"comment,omitempty"`
+}
+
+// PageHistory is every revision of a page, oldest first.
+type PageHistory struct {
+	Path      string         `json:"path"`
+	Revisions []PageRevision `json:"revisions"`
+}
+
+// Revision returns the revision of the page with the given version.
+func (h PageHistory) Revision(version int) (PageRevision, bool) {
+	for _, revision := range h.Revisions {
+		if revision.Version == version {
+			return revision, true
+		}
+	}
+	return PageRevision{}, false
+}
+
+// Newest are the revisions of the page, newest first.
+func (h PageHistory) Newest() []PageRevision {
+	var newest []PageRevision
+	for i := len(h.Revisions) - 1; i >= 0; i-- {
+		newest = append(newest, h.Revisions[i])
+	}
+	return newest
+}
+
+func GetPageHistory(db *bolt.DB, pagePath string) (PageHistory, error) {
+	history := PageHistory{Path: pagePath}
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		history.Revisions, err = pageRevisions(tx.Bucket([]byte("revisions")), pagePath)
+		return err
+	})
+	return history, err
+}
+
+// AddPageRevisions records revisions of a page, numbering them after the
+// revisions already recorded.
+func AddPageRevisions(db *bolt.DB, pagePath string, revisions ...PageRevision) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return addPageRevisions(tx.Bucket([]byte("revisions")), pagePath, revisions)
+	})
+}
+
+// ReplacePageRevisions records revisions as the whole history of a page,
+// removing any revisions already recorded.
+func ReplacePageRevisions(db *bolt.DB, pagePath string, revisions ...PageRevision) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return replacePageRevisions(tx.Bucket([]byte("revisions")), pagePath, revisions)
+	})
+}
+
+// Each page has a bucket of its own in the revisions bucket, with a key for
+// each version, so that saving a page only writes the new revision. Pages
+// saved before then have their whole history in one value, which is moved
+// into a bucket when the page is next saved.
+
+func versionKey(version int) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(version))
+	return k
+}
+
+// pageRevisions reads the revisions of a page, oldest first.
+func pageRevisions(bucket *bolt.Bucket, pagePath string) ([]PageRevision, error) {
+	if v := bucket.Get([]byte(pagePath)); v != nil {
+		var history PageHistory
+		err := json.Unmarshal(v, &history)
+		return history.Revisions, err
+	}
+	pageBucket := bucket.Bucket([]byte(pagePath))
+	if pageBucket == nil {
+		return nil, nil
+	}
+	var revisions []PageRevision
+	err := pageBucket.ForEach(func(k, v []byte) error {
+		var revision PageRevision
+		err := json.Unmarshal(v, &revision)
+		if err != nil {
+			return err
+		}
+		revisions = append(revisions, revision)
+		return nil
+	})
+	return revisions, err
+}
+
+func addPageRevisions(bucket *bolt.Bucket, pagePath string, revisions []PageRevision) error {
+	var legacy []PageRevision
+	if v := bucket.Get([]byte(pagePath)); v != nil {
+		var err error
+		legacy, err = pageRevisions(bucket, pagePath)
+		if err != nil {
+			return err
+		}
+		err = bucket.Delete([]byte(pagePath))
+		if err != nil {
+			return err
+		}
+	}
+	pageBucket, err := bucket.CreateBucketIfNotExists([]byte(pagePath))
+	if err != nil {
+		return err
+	}
+
+	version := 0
+	if k, _ := pageBucket.Cursor().Last(); k != nil {
+		version = int(binary.BigEndian.Uint64(k))
+	}
+	for _, revision := range append(legacy, revisions...) {
+		version++
+		revision.Version = version
+		b, err := json.Marshal(revision)
+		if err != nil {
+			return err
+		}
+		err = pageBucket.Put(versionKey(version), b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replacePageRevisions(bucket *bolt.Bucket, pagePath string, revisions []PageRevision) error {
+	if v := bucket.Get([]byte(pagePath)); v != nil {
+		err := bucket.Delete([]byte(pagePath))
+		if err != nil {
+			return err
+		}
+	} else if bucket.Bucket([]byte(pagePath)) != nil {
+		err := bucket.DeleteBucket([]byte(pagePath))
+		if err != nil {
+			return err
+		}
+	}
+	return addPageRevisions(bucket, pagePath, revisions)
+}
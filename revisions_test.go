@@ -0,0 +1,71 @@
+package wikie
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"path/filepath"
+	"testing"
+)
+
+func TestPageRevisions(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "perms.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = Init(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A history from before each page had a bucket of its own.
+	legacy, _ := json.Marshal(PageHistory{Path: "/a", Revisions: []PageRevision{{Version: 1, Body: "one"}, {Version: 2, Body: "two"}}})
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("revisions")).Put([]byte("/a"), legacy)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := func(pagePath string) []string {
+		history, err := GetPageHistory(db, pagePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bodies []string
+		for i, revision := range history.Revisions {
+			if revision.Version != i+1 {
+				t.Errorf("revision %d of %s is version %d", i, pagePath, revision.Version)
+			}
+			bodies = append(bodies, revision.Body)
+		}
+		return bodies
+	}
+
+	if got := bodies("/a"); len(got) != 2 || got[1] != "two" {
+		t.Errorf("legacy history = %v", got)
+	}
+	err = AddPageRevisions(db, "/a", PageRevision{Body: "three"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bodies("/a"); len(got) != 3 || got[0] != "one" || got[2] != "three" {
+		t.Errorf("history after adding = %v", got)
+	}
+	for i := 0; i < 300; i++ {
+		err = AddPageRevisions(db, "/b", PageRevision{Body: "b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := bodies("/b"); len(got) != 300 {
+		t.Errorf("%d revisions of /b, want 300", len(got))
+	}
+	err = ReplacePageRevisions(db, "/a", PageRevision{Body: "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bodies("/a"); len(got) != 1 || got[0] != "new" {
+		t.Errorf("history after replacing = %v", got)
+	}
+}
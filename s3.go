@@ -0,0 +1,111 @@
+package wikie
+
+import (
+	"context"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"path"
+	"strings"
+)
+
+// S3BlobStore keeps files in a bucket of an S3-compatible object store, such
+// as AWS S3 or MinIO.
+type S3BlobStore struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewS3BlobStore(config S3Config) (*S3BlobStore, error) {
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.SSL,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3BlobStore{
+		client: client,
+		bucket: config.Bucket,
+		prefix: strings.Trim(config.Prefix, "/"),
+	}, nil
+}
+
+func (s *S3BlobStore) object(key string) string {
+	if len(s.prefix) == 0 {
+		return key
+	}
+	return path.Join(s.prefix, key)
+}
+
+func (s *S3BlobStore) key(object string) string {
+	if len(s.prefix) == 0 {
+		return object
+	}
+	return strings.TrimPrefix(object, s.prefix+"/")
+}
+
+// s3Error maps a missing object to ErrBlobNotFound.
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	if code := minio.ToErrorResponse(err).Code; code == "NoSuchKey" || code == "NotFound" {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, s.object(key), r, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *S3BlobStore) Open(ctx context.Context, key string) (io.ReadSeekCloser, BlobInfo, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.object(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, BlobInfo{}, s3Error(err)
+	}
+	// The object is fetched lazily, so this is the first request made.
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, BlobInfo{}, s3Error(err)
+	}
+	return obj, BlobInfo{Key: key, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *S3BlobStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, s.object(key), minio.StatObjectOptions{})
+	if err != nil {
+		return BlobInfo{}, s3Error(err)
+	}
+	return BlobInfo{Key: key, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, s.object(key), minio.RemoveObjectOptions{})
+}
+
+func (s *S3BlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	// Hidden elements are only looked for below the folder of the prefix.
+	folder := prefix[:strings.LastIndex(prefix, "/")+1]
+	// Joining would drop the trailing slash that keeps a/ from matching ab.
+	if len(s.prefix) > 0 {
+		prefix = s.prefix + "/" + prefix
+	}
+	var blobs []BlobInfo
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		key := s.key(obj.Key)
+		if rest := strings.TrimPrefix(key, folder); strings.HasPrefix(rest, ".") || strings.Contains(rest, "/.") {
+			continue
+		}
+		blobs = append(blobs, BlobInfo{Key: key, Size: obj.Size, ModTime: obj.LastModified})
+	}
+	return blobs, nil
+}
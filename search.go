@@ -0,0 +1,134 @@
+package wikie
+
+import (
+	"strings"
+	"time"
+)
+
+// searchDateLayout is the layout of the after: and before: filters.
+const searchDateLayout = "2006-01-02"
+
+// SearchQuery is a free-text query together with the structured filters that
+// can be written inline, e.g. `runbook author:alice ns:/ops tag:oncall`.
+type SearchQuery struct {
+	Text      string
+	Namespace string
+	Author    string
+	Tags      []string
+	Public    string
+	After     time.Time
+	Before    time.Time
+}
+
+// ParseSearchQuery splits q into free text and filters. Terms which look like
+// filters but have an unknown key or an invalid value are left in the text.
+func ParseSearchQuery(q string) SearchQuery {
+	var query SearchQuery
+	var text []string
+	for _, term := range strings.Fields(q) {
+		if !query.set(term) {
+			text = append(text, term)
+		}
+	}
+	query.Text = strings.Join(text, " ")
+	return query
+}
+
+func (q *SearchQuery) set(term string) bool {
+	i := strings.Index(term, ":")
+	if i <= 0 || i == len(term)-1 {
+		return false
+	}
+	key, value := strings.ToLower(term[:i]), term[i+1:]
+	switch key {
+	case "ns", "namespace":
+		q.Namespace = "/" + strings.Trim(value, "/")
+	case "author":
+		q.Author = value
+	case "tag":
+		q.Tags = append(q.Tags, value)
+	case "public":
+		if value != "true" && value != "false" {
+			return false
+		}
+		q.Public = value
+	case "after", "before":
+		t, err := time.Parse(searchDateLayout, value)
+		if err != nil {
+			return false
+		}
+		if key == "after" {
+			q.After = t
+		} else {
+			q.Before = t
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// With returns the query string with the filter key set to value, replacing
+// any existing value for that key (tags are added to rather than replaced).
+func (q SearchQuery) With(key, value string) string {
+	if key != "tag" {
+		q = q.without(key)
+	}
+	q.set(key + ":" + value)
+	return q.String()
+}
+
+// Without returns the query string with the filter key removed.
+func (q SearchQuery) Without(key string) string {
+	return q.without(key).String()
+}
+
+func (q SearchQuery) without(key string) SearchQuery {
+	switch key {
+	case "ns", "namespace":
+		q.Namespace = ""
+	case "author":
+		q.Author = ""
+	case "tag":
+		q.Tags = nil
+	case "public":
+		q.Public = ""
+	case "after":
+		q.After = time.Time{}
+	case "before":
+		q.Before = time.Time{}
+	}
+	return q
+}
+
+// Filtered reports whether any structured filter is set.
+func (q SearchQuery) Filtered() bool {
+	return len(q.Namespace) > 0 || len(q.Author) > 0 || len(q.Tags) > 0 || len(q.Public) > 0 || !q.After.IsZero() || !q.Before.IsZero()
+}
+
+// String formats the query back into the inline syntax accepted by ParseSearchQuery.
+func (q SearchQuery) String() string {
+	var terms []string
+	if len(q.Text) > 0 {
+		terms = append(terms, q.Text)
+	}
+	if len(q.Namespace) > 0 {
+		terms = append(terms, "ns:"+q.Namespace)
+	}
+	if len(q.Author) > 0 {
+		terms = append(terms, "author:"+q.Author)
+	}
+	for _, tag := range q.Tags {
+		terms = append(terms, "tag:"+tag)
+	}
+	if len(q.Public) > 0 {
+		terms = append(terms, "public:"+q.Public)
+	}
+	if !q.After.IsZero() {
+		terms = append(terms, "after:"+q.After.Format(searchDateLayout))
+	}
+	if !q.Before.IsZero() {
+		terms = append(terms, "before:"+q.Before.Format(searchDateLayout))
+	}
+	return strings.Join(terms, " ")
+}
@@ -0,0 +1,51 @@
+package wikie
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	for _, test := range []struct {
+		q    string
+		want SearchQuery
+	}{
+		{"", SearchQuery{}},
+		{"disk full", SearchQuery{Text: "disk full"}},
+		{"runbook author:alice ns:ops/ tag:oncall", SearchQuery{Text: "runbook", Author: "alice", Namespace: "/ops", Tags: []string{"oncall"}}},
+		{"Namespace:/ops/db", SearchQuery{Namespace: "/ops/db"}},
+		{"tag:a tag:b", SearchQuery{Tags: []string{"a", "b"}}},
+		{"public:true", SearchQuery{Public: "true"}},
+		{"public:yes", SearchQuery{Text: "public:yes"}},
+		{"after:2020-01-02 before:2020-02-03", SearchQuery{After: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), Before: time.Date(2020, 2, 3, 0, 0, 0, 0, time.UTC)}},
+		{"after:yesterday", SearchQuery{Text: "after:yesterday"}},
+		{"http://example.com :x x: colour:red", SearchQuery{Text: "http://example.com :x x: colour:red"}},
+	} {
+		got := ParseSearchQuery(test.q)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseSearchQuery(%q) = %+v, want %+v", test.q, got, test.want)
+		}
+	}
+}
+
+func TestSearchQueryWith(t *testing.T) {
+	q := ParseSearchQuery("runbook author:alice tag:oncall")
+	for _, test := range []struct {
+		got, want string
+	}{
+		{q.String(), "runbook author:alice tag:oncall"},
+		{q.With("author", "bob"), "runbook author:bob tag:oncall"},
+		{q.With("tag", "db"), "runbook author:alice tag:oncall tag:db"},
+		{q.With("ns", "ops"), "runbook ns:/ops author:alice tag:oncall"},
+		{q.Without("tag"), "runbook author:alice"},
+		{q.Without("author"), "runbook tag:oncall"},
+	} {
+		if test.got != test.want {
+			t.Errorf("got %q, want %q", test.got, test.want)
+		}
+	}
+	if !q.Filtered() || ParseSearchQuery("runbook").Filtered() {
+		t.Errorf("Filtered is wrong")
+	}
+}
@@ -0,0 +1,85 @@
+package wikie
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"sort"
+	"time"
+)
+
+// Session is a login to the wiki. Sessions are kept so that they last across
+// restarts, and so that they can be revoked.
+type Session struct {
+	Token   string    `json:"token"`
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+}
+
+// AddSession records that user has logged in with token.
+func AddSession(db *bolt.DB, token, user string) error {
+	b, err := json.Marshal(Session{Token: token, User: user, Created: time.Now()})
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("sessions")).Put([]byte(token), b)
+	})
+}
+
+// GetSessions returns every session, oldest first.
+func GetSessions(db *bolt.DB) ([]Session, error) {
+	var sessions []Session
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("sessions"))
+		if bucket == nil {
+			// The database is from before sessions were kept.
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var session Session
+			err := json.Unmarshal(v, &session)
+			if err != nil {
+				return err
+			}
+			sessions = append(sessions, session)
+			return nil
+		})
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+	return sessions, err
+}
+
+// RemoveSessions removes the sessions for which remove is true, returning them.
+func RemoveSessions(db *bolt.DB, remove func(Session) bool) ([]Session, error) {
+	var removed []Session
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("sessions"))
+		var keys [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var session Session
+			err := json.Unmarshal(v, &session)
+			if err != nil {
+				return err
+			}
+			if remove(session) {
+				keys = append(keys, k)
+				removed = append(removed, session)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Keys cannot be deleted while iterating over the bucket.
+		for _, k := range keys {
+			err := bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,203 @@
+package wikie
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/go-errors/errors"
+	"golang.org/x/crypto/bcrypt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SharePage = "page"
+	ShareFile = "file"
+)
+
+var (
+	// ErrInvalidShare is returned for share links which were not made by
+	// wikie, or which have been revoked or have expired.
+	ErrInvalidShare = errors.New("invalid share link")
+	// ErrSharePassword is returned when the password of a share link is wrong.
+	ErrSharePassword = errors.New("incorrect password")
+)
+
+// Share gives anyone holding its link read only access to a single page or
+// file until it expires or is revoked.
+type Share struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Path      string    `json:"path"`
+	CreatedBy string    `json:"createdBy"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	// PasswordHash is the bcrypt hash of the password, if the share has one.
+	PasswordHash []byte `json:"passwordHash,omitempty"`
+	Revoked      bool   `json:"revoked"`
+}
+
+func (s Share) HasPassword() bool {
+	return len(s.PasswordHash) > 0
+}
+
+func (s Share) Expired(now time.Time) bool {
+	return !now.Before(s.Expires)
+}
+
+// CheckPassword returns ErrSharePassword unless password is the share's password.
+func (s Share) CheckPassword(password string) error {
+	if !s.HasPassword() {
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword(s.PasswordHash, []byte(password)) != nil {
+		return ErrSharePassword
+	}
+	return nil
+}
+
+// Token is the part of the share link which identifies and authenticates it.
+func (s Share) Token(secret string) string {
+	return s.ID + "." + base64.RawURLEncoding.EncodeToString(s.signature(secret))
+}
+
+// signature covers everything which decides what the link gives access to,
+// so a share cannot be altered in the database to reach something else.
+func (s Share) signature(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", s.ID, s.Kind, s.Path, strconv.FormatInt(s.Expires.Unix(), 10))
+	return mac.Sum(nil)
+}
+
+// Allows reports whether the share gives access to the file at filePath. A
+// page share also gives access to the files uploaded to the page.
+func (s Share) Allows(filePath string) bool {
+	switch s.Kind {
+	case ShareFile:
+		return filePath == s.Path
+	case SharePage:
+		return path.Dir(filePath) == s.Path
+	}
+	return false
+}
+
+// NewShare creates a share of the page or file at sharePath which expires
+// after ttl. An empty password means the link alone gives access.
+func NewShare(db *bolt.DB, kind, sharePath, user string, ttl time.Duration, password string) (Share, error) {
+	if kind != SharePage && kind != ShareFile {
+		return Share{}, fmt.Errorf("cannot share a %s", kind)
+	}
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return Share{}, err
+	}
+	now := time.Now()
+	share := Share{
+		ID:        hex.EncodeToString(id),
+		Kind:      kind,
+		Path:      sharePath,
+		CreatedBy: user,
+		Created:   now,
+		Expires:   now.Add(ttl).Truncate(time.Second),
+	}
+	if len(password) > 0 {
+		share.PasswordHash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return Share{}, err
+		}
+	}
+	return share, putShare(db, share)
+}
+
+func putShare(db *bolt.DB, share Share) error {
+	b, err := json.Marshal(share)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("shares")).Put([]byte(share.ID), b)
+	})
+}
+
+func getShare(db *bolt.DB, id string) (Share, bool, error) {
+	var share Share
+	var found bool
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("shares")).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &share)
+	})
+	return share, found, err
+}
+
+// VerifyShare returns the share a link's token is for, provided it is still valid.
+func VerifyShare(db *bolt.DB, secret, token string) (Share, error) {
+	i := strings.Index(token, ".")
+	if i <= 0 {
+		return Share{}, ErrInvalidShare
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return Share{}, ErrInvalidShare
+	}
+	share, found, err := getShare(db, token[:i])
+	if err != nil {
+		return Share{}, err
+	}
+	if !found || subtle.ConstantTimeCompare(signature, share.signature(secret)) != 1 {
+		return Share{}, ErrInvalidShare
+	}
+	if share.Revoked || share.Expired(time.Now()) {
+		return Share{}, ErrInvalidShare
+	}
+	return share, nil
+}
+
+// RevokeShare stops a share link from working.
+func RevokeShare(db *bolt.DB, id string) error {
+	share, found, err := getShare(db, id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrInvalidShare
+	}
+	share.Revoked = true
+	return putShare(db, share)
+}
+
+// GetShares returns the shares made by user, or every share if user is
+// empty, newest first.
+func GetShares(db *bolt.DB, user string) ([]Share, error) {
+	var shares []Share
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("shares")).ForEach(func(k, v []byte) error {
+			var share Share
+			err := json.Unmarshal(v, &share)
+			if err != nil {
+				return err
+			}
+			if len(user) == 0 || share.CreatedBy == user {
+				shares = append(shares, share)
+			}
+			return nil
+		})
+	})
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].Created.After(shares[j].Created)
+	})
+	return shares, err
+}
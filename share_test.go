@@ -0,0 +1,121 @@
+package wikie
+
+import (
+	"github.com/boltdb/bolt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyShare(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "perms.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = Init(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const secret = "secret"
+	share, err := NewShare(db, SharePage, "/ops/runbook", "alice", time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := share.Token(secret)
+
+	got, err := VerifyShare(db, secret, token)
+	if err != nil || got.ID != share.ID || got.Path != share.Path {
+		t.Fatalf("VerifyShare = %+v, %v, want the share", got, err)
+	}
+
+	// A share altered in the database no longer matches its links.
+	moved := share
+	moved.Path = "/ops/secrets"
+	err = putShare(db, moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyShare(db, secret, token); err != ErrInvalidShare {
+		t.Errorf("VerifyShare of a moved share = %v, want ErrInvalidShare", err)
+	}
+	err = putShare(db, share)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := share
+	expired.ID = "expired"
+	expired.Expires = time.Now().Add(-time.Minute).Truncate(time.Second)
+	err = putShare(db, expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		secret, token string
+	}{
+		{"other", token},
+		{secret, ""},
+		{secret, share.ID},
+		{secret, "." + token},
+		{secret, share.ID + ".!!"},
+		{secret, "unknown" + token[len(share.ID):]},
+		{secret, expired.Token(secret)},
+	} {
+		if _, err := VerifyShare(db, test.secret, test.token); err != ErrInvalidShare {
+			t.Errorf("VerifyShare(%q, %q) = %v, want ErrInvalidShare", test.secret, test.token, err)
+		}
+	}
+
+	err = RevokeShare(db, share.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyShare(db, secret, token); err != ErrInvalidShare {
+		t.Errorf("VerifyShare of a revoked share = %v, want ErrInvalidShare", err)
+	}
+}
+
+func TestShareAccess(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "perms.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = Init(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewShare(db, "namespace", "/ops", "alice", time.Hour, ""); err == nil {
+		t.Errorf("NewShare of a namespace succeeded")
+	}
+	share, err := NewShare(db, ShareFile, "/ops/a.pdf", "alice", time.Hour, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !share.HasPassword() || share.CheckPassword("hunter2") != nil || share.CheckPassword("hunter3") != ErrSharePassword {
+		t.Errorf("share password is not checked")
+	}
+
+	page := Share{Kind: SharePage, Path: "/ops/runbook"}
+	file := Share{Kind: ShareFile, Path: "/ops/a.pdf"}
+	for _, test := range []struct {
+		share    Share
+		filePath string
+		want     bool
+	}{
+		{page, "/ops/runbook/a.pdf", true},
+		{page, "/ops/runbook/sub/a.pdf", false},
+		{page, "/ops/a.pdf", false},
+		{file, "/ops/a.pdf", true},
+		{file, "/ops/b.pdf", false},
+		{Share{Kind: "namespace", Path: "/ops"}, "/ops/a.pdf", false},
+	} {
+		if got := test.share.Allows(test.filePath); got != test.want {
+			t.Errorf("%s share of %s allows %s = %v, want %v", test.share.Kind, test.share.Path, test.filePath, got, test.want)
+		}
+	}
+}
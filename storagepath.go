@@ -0,0 +1,49 @@
+package wikie
+
+import (
+	"github.com/go-errors/errors"
+	"strings"
+)
+
+// ErrUnsafePath is returned for storage paths which could refer to a file
+// outside of storage, or to a file wikie manages itself.
+var ErrUnsafePath = errors.New("unsafe storage path")
+
+// ResolveStoragePath turns a user supplied path of a file (or namespace) in
+// storage into its canonical form, e.g. ops/./runbook.pdf becomes
+// /ops/runbook.pdf. The leading slash is optional; the root of storage is /.
+//
+// Every route that touches storage resolves paths with this function, and uses
+// the result both for permission checks and to access the file, so that the
+// two can never disagree. Paths are rejected rather than cleaned when they
+// contain .. elements, backslashes, NUL bytes, hidden (dot) files, or are
+// absolute in their own right (//host/x, C:/x).
+func ResolveStoragePath(p string) (string, error) {
+	if strings.ContainsAny(p, "\\\x00") {
+		return "", ErrUnsafePath
+	}
+	p = strings.TrimPrefix(p, "/")
+	if strings.HasPrefix(p, "/") {
+		return "", ErrUnsafePath
+	}
+
+	var elems []string
+	for i, elem := range strings.Split(p, "/") {
+		switch {
+		case elem == "" || elem == ".":
+			continue
+		case elem == "..", strings.HasPrefix(elem, "."):
+			return "", ErrUnsafePath
+		case i == 0 && strings.HasSuffix(elem, ":"):
+			// A drive letter or URL scheme.
+			return "", ErrUnsafePath
+		}
+		elems = append(elems, elem)
+	}
+	return "/" + strings.Join(elems, "/"), nil
+}
+
+// StorageKey is the BlobStore key of a path returned by ResolveStoragePath.
+func StorageKey(resolved string) string {
+	return strings.TrimPrefix(resolved, "/")
+}
@@ -0,0 +1,133 @@
+package wikie
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func FuzzResolveStoragePath(f *testing.F) {
+	for _, seed := range []string{
+		"", "/", "ops/runbook.pdf", "/ops/./runbook.pdf", "../", "/..", "%2e%2e/", "a/../../b",
+		"a/b/..", "\x00", "a\x00b", "//x", "///x", "a//b", "a\\..\\b", "C:/x", "c:", ".hidden", "a/.git/config",
+		"a..b/c...d",
+	} {
+		f.Add(seed)
+	}
+	root := f.TempDir()
+	store := NewLocalBlobStore(root)
+	f.Fuzz(func(t *testing.T, p string) {
+		resolved, err := ResolveStoragePath(p)
+		if err != nil {
+			if err != ErrUnsafePath {
+				t.Fatalf("ResolveStoragePath(%q) returned %v", p, err)
+			}
+			return
+		}
+		if !strings.HasPrefix(resolved, "/") || path.Clean(resolved) != resolved {
+			t.Fatalf("ResolveStoragePath(%q) = %q, which is not clean", p, resolved)
+		}
+		// A name such as a..b is fine; only whole .. elements climb out.
+		for _, elem := range strings.Split(resolved, "/") {
+			if elem == ".." {
+				t.Fatalf("ResolveStoragePath(%q) = %q, which has a .. element", p, resolved)
+			}
+		}
+		if again, err := ResolveStoragePath(resolved); err != nil || again != resolved {
+			t.Fatalf("ResolveStoragePath(%q) = %q, but that resolves to %q, %v", p, resolved, again, err)
+		}
+
+		file, err := store.path(StorageKey(resolved))
+		if err == ErrUnsafePath {
+			t.Fatalf("LocalBlobStore rejects %q, which ResolveStoragePath accepted from %q", resolved, p)
+		} else if err != nil {
+			// Such as a name which is too long for the filesystem.
+			return
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+			t.Fatalf("%q from %q is kept at %s, outside of %s", resolved, p, file, root)
+		}
+	})
+}
+
+func TestLocalBlobStoreSymlinks(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	outside := t.TempDir()
+	store := NewLocalBlobStore(root)
+
+	err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(root, "a"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"dir":      outside,
+		"a/file":   filepath.Join(outside, "secret"),
+		"dangling": filepath.Join(outside, "created"),
+		"a/up":     "..",
+		"relative": "a",
+	} {
+		err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(link)))
+		if err != nil {
+			t.Skipf("symbolic links are not supported: %v", err)
+		}
+	}
+
+	for _, key := range []string{"dir", "dir/secret", "a/file", "dangling", "a/up/a", "relative/x"} {
+		if _, err := store.path(key); err != ErrUnsafePath {
+			t.Errorf("path(%q) = %v, want ErrUnsafePath", key, err)
+		}
+		if _, _, err := store.Open(ctx, key); err != ErrUnsafePath {
+			t.Errorf("Open(%q) = %v, want ErrUnsafePath", key, err)
+		}
+		if _, err := store.Stat(ctx, key); err != ErrUnsafePath {
+			t.Errorf("Stat(%q) = %v, want ErrUnsafePath", key, err)
+		}
+		if err := store.Delete(ctx, key); err != ErrUnsafePath {
+			t.Errorf("Delete(%q) = %v, want ErrUnsafePath", key, err)
+		}
+	}
+
+	// Writing through a link must not reach outside the root.
+	if err := store.Put(ctx, "dangling", strings.NewReader("x"), 1, "text/plain"); err != ErrUnsafePath {
+		t.Errorf("Put through a dangling link = %v, want ErrUnsafePath", err)
+	}
+	if err := store.Put(ctx, "dir/new", strings.NewReader("x"), 1, "text/plain"); err != ErrUnsafePath {
+		t.Errorf("Put into a linked directory = %v, want ErrUnsafePath", err)
+	}
+	for _, name := range []string{"created", "new"} {
+		if _, err := os.Lstat(filepath.Join(outside, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was written outside of the root", name)
+		}
+	}
+	if b, _ := os.ReadFile(filepath.Join(outside, "secret")); string(b) != "secret" {
+		t.Errorf("the file outside the root was changed")
+	}
+
+	// Links are not listed, and what does not exist yet is inside the root.
+	blobs, err := store.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) > 0 {
+		t.Errorf("List listed %v", blobs)
+	}
+	p, err := store.path("b/c/new.txt")
+	if err != nil || p != filepath.Join(root, "b", "c", "new.txt") {
+		t.Errorf("path(b/c/new.txt) = %s, %v", p, err)
+	}
+
+	for _, key := range []string{"../x", "/x", "a/../b", "a//b", "a/./b", "a\\b", "a\x00b", "C:/x", "a/"} {
+		if _, err := store.path(key); err != ErrUnsafePath {
+			t.Errorf("path(%q) = %v, want ErrUnsafePath", key, err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package wikie
+
+import (
+	"fmt"
+	"time"
+)
+
+// timestampLayouts are the formats timestamps have been stored in, newest first.
+var timestampLayouts = []string{time.RFC3339Nano, time.RFC822}
+
+// ParseTimestamp parses a timestamp read from the index. Documents written
+// before timestamps were stored as RFC 3339 hold RFC 822 strings instead.
+func ParseTimestamp(s string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown timestamp format %q", s)
+}
+
+// RelativeTime describes how long before now t was, e.g. "3 hours ago", or
+// how long until it is for times yet to come, e.g. "in 2 days".
+func RelativeTime(t, now time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	d := now.Sub(t)
+	future := d < 0
+	if future {
+		d = -d
+	}
+	plural := func(n int, unit string) string {
+		if n != 1 {
+			unit += "s"
+		}
+		if future {
+			return fmt.Sprintf("in %d %s", n, unit)
+		}
+		return fmt.Sprintf("%d %s ago", n, unit)
+	}
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int(d/time.Minute), "minute")
+	case d < 24*time.Hour:
+		return plural(int(d/time.Hour), "hour")
+	case d < 30*24*time.Hour:
+		return plural(int(d/(24*time.Hour)), "day")
+	case d < 365*24*time.Hour:
+		return plural(int(d/(30*24*time.Hour)), "month")
+	default:
+		return plural(int(d/(365*24*time.Hour)), "year")
+	}
+}
+
+// LocalTime formats t in the time zone loc, or UTC when loc is nil.
+func LocalTime(t time.Time, loc *time.Location) string {
+	if t.IsZero() {
+		return ""
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	return t.In(loc).Format("Mon, 2 Jan 2006 15:04 MST")
+}